@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/gkhit/gscltmsd/route"
+)
+
+// BulkLoad copy rows of topic, receive time and payload into staging table with bulk copy protocol
+// and call post-load procedure in one transaction, so rows are not loaded if the procedure fails
+func BulkLoad(ctx context.Context, pool *sql.DB, b *route.Bulk, rows [][]interface{}) (err error) {
+	txn, err := pool.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			txn.Rollback()
+		}
+	}()
+
+	stmt, err := txn.PrepareContext(ctx, mssql.CopyIn(b.Table, mssql.BulkOptions{Tablock: b.Tablock}, b.Columns()...))
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if _, err = stmt.ExecContext(ctx, r...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	// Exec without arguments sends buffered rows
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err = stmt.Close(); err != nil {
+		return err
+	}
+
+	if len(b.PostLoad) > 0 {
+		if _, err = txn.ExecContext(ctx, b.PostLoad); err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
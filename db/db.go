@@ -3,10 +3,14 @@ package db
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/gkhit/gscltmsd/route"
+
 	// MS SQL
 	_ "github.com/denisenkom/go-mssqldb"
 )
@@ -21,14 +25,68 @@ type (
 		Password       string `json:"password,omitempty"`
 		Timeout        int64  `json:"timeout,omitempty"`
 		EntryPointFunc string `json:"entry_point"`
-		ToXML          bool   `json:"to_xml,omitempty"`
 		XMLRoot        string `json:"xml_root,omitempty"`
 		XMLExtArray    bool   `json:"xml_ext_array,omitempty"`
+		// ToXML convert JSON payload to XML, true if not set
+		ToXML *bool `json:"to_xml,omitempty"`
+		// Format of payload passed to entry point, chosen by ToXML if default
+		Format route.Format `json:"format,omitempty"`
+		// JSONCanonical re-serialize JSON payload with sorted keys
+		JSONCanonical bool `json:"json_canonical,omitempty"`
+		// JSONMinify remove insignificant whitespace from JSON payload
+		JSONMinify bool `json:"json_minify,omitempty"`
+		// JSONKeyCase change case of JSON object keys
+		JSONKeyCase route.KeyCase `json:"json_key_case,omitempty"`
+		// Query parameterized T-SQL statement called instead of entry point procedure
+		Query string `json:"query,omitempty"`
+		// Params named parameters of entry point or query, topic and payload are passed if empty
+		Params []route.Param `json:"params,omitempty"`
+		// SegmentAttributes add named levels of topic template as attributes of XML root element
+		SegmentAttributes bool `json:"segment_attributes,omitempty"`
+		// SegmentParams pass named levels of topic template as extra nvarchar parameters
+		SegmentParams bool `json:"segment_params,omitempty"`
+		// SegmentFields add named levels of topic template to JSON payload as fields before conversion
+		SegmentFields bool `json:"segment_fields,omitempty"`
+		// Table rows are inserted into table instead of calling entry point
+		Table *route.Table `json:"table,omitempty"`
+		// Bulk messages are bulk loaded into staging table instead of calling entry point
+		Bulk *route.Bulk `json:"bulk,omitempty"`
+		// Flatten leaves of JSON payload are passed as table-valued parameter instead of converted payload
+		Flatten *route.Flatten `json:"flatten,omitempty"`
+		// Reply results of entry point are published to MQTT
+		Reply *route.Reply `json:"reply,omitempty"`
+		// DeviceIDSegment number of topic level holding device id, starting from 1, negative numbers count from the end
+		DeviceIDSegment int `json:"device_id_segment,omitempty"`
+		// Schema JSON schema payload is validated against before conversion, violations are rejected
+		Schema json.RawMessage `json:"schema,omitempty"`
+		// SchemaFile file of JSON schema, used if schema is empty
+		SchemaFile string `json:"schema_file,omitempty"`
+		// BatchSize max number of messages in one call of batch entry point, batching is disabled if less than 2.
+		// Only messages converted to XML are batched.
+		BatchSize int `json:"batch_size,omitempty"`
+		// BatchInterval max time in milliseconds to wait for a batch to fill, must be positive if batching is enabled
+		BatchInterval int64 `json:"batch_interval,omitempty"`
+		// BatchEntryPointFunc procedure accepting XML document with a batch of messages
+		BatchEntryPointFunc string `json:"batch_entry_point,omitempty"`
+		// BatchRoot root tag of batch XML document
+		BatchRoot string `json:"batch_root,omitempty"`
+		// RetryAttempts max number of attempts of entry point call on transient errors
+		RetryAttempts int `json:"retry_attempts,omitempty"`
+		// RetryInterval initial interval in milliseconds between attempts, doubled after each attempt
+		RetryInterval int64 `json:"retry_interval,omitempty"`
+		// RetryMaxInterval max interval in milliseconds between attempts
+		RetryMaxInterval int64 `json:"retry_max_interval,omitempty"`
+		// RetryMaxElapsed max time in seconds spent on attempts
+		RetryMaxElapsed int64 `json:"retry_max_elapsed,omitempty"`
+		// RetriableErrors SQL server error numbers treated as transient, DefaultRetriableErrors if empty
+		RetriableErrors []int32 `json:"retriable_errors,omitempty"`
+		// Logger of connection and retry messages, standard logger is used if nil
+		Logger *log.Logger `json:"-"`
 	}
 )
 
-// New return new database connection pool
-func New(o *Options) *sql.DB {
+// New return new database connection pool, SQL server is pinged to check connection
+func New(o *Options) (*sql.DB, error) {
 	var (
 		err     error
 		connStr string
@@ -44,17 +102,26 @@ func New(o *Options) *sql.DB {
 			o.Host, o.User, o.Password, o.Port, o.DBName)
 	}
 	// Create connection pool
-	log.Printf("[INFO] Try connect to SQL Server: %s\n", connStr)
+	o.logger().Printf("[INFO] Try connect to SQL Server: %s\n",
+		strings.Replace(connStr, "password="+o.Password+";", "password=***;", 1))
 	poolDB, err = sql.Open("sqlserver", connStr)
 	if err != nil {
-		log.Fatalf("[ERROR] Can't connect to SQL server. %v\n", err)
+		return nil, err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.Timeout)*time.Second)
 	defer cancel()
 	err = poolDB.PingContext(ctx)
 	if err != nil {
-		log.Fatalf("[ERROR] Can't PING to SQL server. %v\n", err)
+		poolDB.Close()
+		return nil, err
+	}
+	return poolDB, nil
+}
+
+func (o *Options) logger() *log.Logger {
+	if o.Logger != nil {
+		return o.Logger
 	}
-	return poolDB
+	return log.Default()
 }
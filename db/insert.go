@@ -0,0 +1,172 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gkhit/gscltmsd/route"
+	"github.com/gkhit/gscltmsd/sm2x"
+)
+
+// Inserter insert messages as rows of table with parameterized INSERT statement
+type Inserter struct {
+	t       *route.Table
+	columns []route.Param
+	query   string
+}
+
+// accepted column types by types of values, SQL server converts the rest implicitly
+var accepted = map[route.SQLType][]route.SQLType{
+	route.NVarCharType:  {route.NVarCharType, route.XMLType, route.DateTime2Type, route.BigIntType, route.BitType},
+	route.XMLType:       {route.NVarCharType, route.XMLType},
+	route.VarBinaryType: {route.VarBinaryType},
+	route.DateTime2Type: {route.DateTime2Type, route.NVarCharType},
+	route.BigIntType:    {route.BigIntType, route.BitType, route.NVarCharType},
+	route.BitType:       {route.BitType, route.BigIntType, route.NVarCharType},
+}
+
+// NewInserter check columns of table and build INSERT statement.
+// Types of columns missing in configuration are read from table.
+func NewInserter(ctx context.Context, pool *sql.DB, t *route.Table) (*Inserter, error) {
+	types, err := columnTypes(ctx, pool, t.Name)
+	if err != nil {
+		return nil, fmt.Errorf("can't read columns of table \"%s\". %v", t.Name, err)
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("table \"%s\" not found", t.Name)
+	}
+
+	ins := &Inserter{t: t}
+	names := make([]string, 0, len(t.Columns)+1)
+	check := func(name string, typ route.SQLType) (route.SQLType, error) {
+		dt, ok := types[strings.ToLower(name)]
+		if !ok {
+			return typ, fmt.Errorf("table \"%s\" has no column \"%s\"", t.Name, name)
+		}
+		ct, ok := sqlType(dt)
+		if !ok {
+			return typ, fmt.Errorf("column \"%s\" of table \"%s\" has unsupported type %s", name, t.Name, dt)
+		}
+		if typ == route.DefaultType {
+			return ct, nil
+		}
+		for _, a := range accepted[typ] {
+			if a == ct {
+				return typ, nil
+			}
+		}
+		return typ, fmt.Errorf("column \"%s\" of table \"%s\" has type %s, can't insert %s", name, t.Name, dt, typ)
+	}
+
+	for _, c := range t.Columns {
+		if c.Type, err = check(c.Name, c.Type); err != nil {
+			return nil, err
+		}
+		ins.columns = append(ins.columns, c)
+		names = append(names, c.Name)
+	}
+	if t.Unmapped == route.OverflowUnmapped {
+		typ := route.NVarCharType
+		if t.OverflowFormat == route.XMLFormat {
+			typ = route.XMLType
+		}
+		if _, err = check(t.OverflowColumn, typ); err != nil {
+			return nil, err
+		}
+		names = append(names, t.OverflowColumn)
+	}
+
+	var cols, params []string
+	for i, n := range names {
+		cols = append(cols, "["+strings.ReplaceAll(n, "]", "]]")+"]")
+		params = append(params, fmt.Sprintf("@p%d", i+1))
+	}
+	ins.query = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.Name, strings.Join(cols, ", "), strings.Join(params, ", "))
+	return ins, nil
+}
+
+// Statement return INSERT statement
+func (i *Inserter) Statement() string {
+	return i.query
+}
+
+// Args return values of columns for message and its payload converted to format of route
+func (i *Inserter) Args(r *route.Options, m *route.Message, payload []byte) ([]interface{}, error) {
+	args, err := r.Values(i.columns, m, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch i.t.Unmapped {
+	case route.ErrorUnmapped:
+		if fields := i.t.UnmappedFields(m.Payload); len(fields) > 0 {
+			names := make([]string, 0, len(fields))
+			for k := range fields {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("fields %q are not mapped to columns of table \"%s\"", names, i.t.Name)
+		}
+	case route.OverflowUnmapped:
+		fields := i.t.UnmappedFields(m.Payload)
+		if len(fields) == 0 {
+			args = append(args, sql.NullString{})
+			break
+		}
+		var data []byte
+		if i.t.OverflowFormat == route.XMLFormat {
+			data, err = sm2x.Map2XML(fields, r.XMLRoot)
+		} else {
+			data, err = json.Marshal(fields)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't build overflow column. %v", err)
+		}
+		args = append(args, string(data))
+	}
+	return args, nil
+}
+
+// columnTypes return data types of table columns by lower case names
+func columnTypes(ctx context.Context, pool *sql.DB, table string) (map[string]string, error) {
+	rows, err := pool.QueryContext(ctx, `SELECT COLUMN_NAME, DATA_TYPE FROM INFORMATION_SCHEMA.COLUMNS
+		WHERE TABLE_NAME = PARSENAME(@p1, 1) AND TABLE_SCHEMA = ISNULL(PARSENAME(@p1, 2), SCHEMA_NAME())`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err = rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		types[strings.ToLower(name)] = strings.ToLower(typ)
+	}
+	return types, rows.Err()
+}
+
+// sqlType return type of values column of data type is filled with
+func sqlType(dataType string) (route.SQLType, bool) {
+	switch dataType {
+	case "xml":
+		return route.XMLType, true
+	case "char", "varchar", "nchar", "nvarchar", "text", "ntext", "uniqueidentifier",
+		"decimal", "numeric", "float", "real", "money", "smallmoney", "time":
+		return route.NVarCharType, true
+	case "binary", "varbinary", "image":
+		return route.VarBinaryType, true
+	case "date", "datetime", "datetime2", "smalldatetime", "datetimeoffset":
+		return route.DateTime2Type, true
+	case "bigint", "int", "smallint", "tinyint":
+		return route.BigIntType, true
+	case "bit":
+		return route.BitType, true
+	}
+	return route.DefaultType, false
+}
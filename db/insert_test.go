@@ -0,0 +1,105 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/gkhit/gscltmsd/route"
+)
+
+func inserter(unmapped route.Unmapped, format route.Format, columns ...route.Param) (*Inserter, *route.Options) {
+	t := &route.Table{Name: "dbo.readings", Columns: columns, Unmapped: unmapped, OverflowColumn: "extra", OverflowFormat: format}
+	return &Inserter{t: t, columns: columns}, &route.Options{Topic: "meter/#", XMLRoot: "doc", Table: t}
+}
+
+func insertArgs(t *testing.T, i *Inserter, r *route.Options, payload string) ([]interface{}, error) {
+	t.Helper()
+	m := &route.Message{Topic: "meter/1", Payload: []byte(payload)}
+	return i.Args(r, m, m.Payload)
+}
+
+var meterColumns = []route.Param{
+	{Name: "meter", Source: route.JSONSource, Path: "meter"},
+	{Name: "value", Source: route.JSONSource, Path: "data.value"},
+}
+
+func TestUnmappedError(t *testing.T) {
+	i, r := inserter(route.ErrorUnmapped, route.DefaultFormat, meterColumns...)
+
+	args, err := insertArgs(t, i, r, `{"meter":"1","data":{"value":2,"unit":"kWh"}}`)
+	if err != nil {
+		t.Fatalf("mapped payload: %v", err)
+	}
+	if len(args) != 2 {
+		t.Errorf("mapped payload: %d args, want 2", len(args))
+	}
+
+	_, err = insertArgs(t, i, r, `{"meter":"1","data":{"value":2},"tariff":1,"alarm":true}`)
+	if err == nil {
+		t.Fatal("unmapped fields accepted")
+	}
+	if !strings.Contains(err.Error(), `["alarm" "tariff"]`) {
+		t.Errorf("error %q doesn't list sorted unmapped fields", err)
+	}
+}
+
+func TestUnmappedIgnore(t *testing.T) {
+	i, r := inserter(route.IgnoreUnmapped, route.DefaultFormat, meterColumns...)
+
+	args, err := insertArgs(t, i, r, `{"meter":"1","data":{"value":2},"tariff":1}`)
+	if err != nil {
+		t.Fatalf("Args: %v", err)
+	}
+	if len(args) != 2 {
+		t.Errorf("%d args, want 2", len(args))
+	}
+}
+
+func TestUnmappedOverflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  route.Format
+		payload string
+		want    interface{}
+	}{
+		{"no unmapped fields", route.JSONFormat, `{"meter":"1","data":{"value":2}}`, sql.NullString{}},
+		{"json", route.JSONFormat, `{"meter":"1","data":{"value":2},"tariff":1,"alarm":true}`, `{"alarm":true,"tariff":1}`},
+		{"xml", route.XMLFormat, `{"meter":"1","data":{"value":2},"tariff":1}`, `<doc><tariff>1</tariff></doc>`},
+		{"not an object", route.JSONFormat, `[1,2]`, sql.NullString{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, r := inserter(route.OverflowUnmapped, tt.format, meterColumns...)
+			args, err := insertArgs(t, i, r, tt.payload)
+			if err != nil {
+				t.Fatalf("Args: %v", err)
+			}
+			if len(args) != 3 {
+				t.Fatalf("%d args, want 3", len(args))
+			}
+			if args[2] != tt.want {
+				t.Errorf("overflow = %#v, want %#v", args[2], tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmappedPayloadColumn(t *testing.T) {
+	columns := append([]route.Param{{Name: "payload", Source: route.PayloadSource}}, meterColumns...)
+	payload := `{"meter":"1","data":{"value":2},"tariff":1}`
+
+	i, r := inserter(route.ErrorUnmapped, route.DefaultFormat, columns...)
+	if _, err := insertArgs(t, i, r, payload); err != nil {
+		t.Errorf("payload stored whole rejected: %v", err)
+	}
+
+	i, r = inserter(route.OverflowUnmapped, route.JSONFormat, columns...)
+	args, err := insertArgs(t, i, r, payload)
+	if err != nil {
+		t.Fatalf("Args: %v", err)
+	}
+	if args[len(args)-1] != (sql.NullString{}) {
+		t.Errorf("overflow = %#v, want NULL", args[len(args)-1])
+	}
+}
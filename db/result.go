@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+// Result first result set, output parameters and return status of entry point call
+type Result struct {
+	Rows         []map[string]interface{} `json:"rows,omitempty"`
+	Output       map[string]interface{}   `json:"output,omitempty"`
+	ReturnStatus int32                    `json:"return_status"`
+}
+
+// QueryResult call query and read its first result set, output parameters and return status.
+// Output parameters are passed as sql.Named with sql.Out value.
+func QueryResult(ctx context.Context, conn *sql.Conn, query string, args []interface{}) (*Result, error) {
+	var rs mssql.ReturnStatus
+	rows, err := conn.QueryContext(ctx, query, append(args, &rs)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := &Result{}
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(cols))
+		for i, c := range cols {
+			// Decimals and binary data come as bytes
+			if b, ok := values[i].([]byte); ok {
+				row[c] = string(b)
+			} else {
+				row[c] = values[i]
+			}
+		}
+		res.Rows = append(res.Rows, row)
+	}
+	// Output parameters and return status are set once all results are read
+	for rows.NextResultSet() {
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	res.ReturnStatus = int32(rs)
+	for _, a := range args {
+		n, ok := a.(sql.NamedArg)
+		if !ok {
+			continue
+		}
+		out, ok := n.Value.(sql.Out)
+		if !ok {
+			continue
+		}
+		if res.Output == nil {
+			res.Output = make(map[string]interface{})
+		}
+		res.Output[n.Name] = outputValue(out.Dest)
+	}
+	return res, nil
+}
+
+// outputValue return value of output parameter destination, nil for NULL
+func outputValue(dest interface{}) interface{} {
+	switch d := dest.(type) {
+	case *sql.NullString:
+		if d.Valid {
+			return d.String
+		}
+	case *sql.NullInt64:
+		if d.Valid {
+			return d.Int64
+		}
+	case *sql.NullBool:
+		if d.Valid {
+			return d.Bool
+		}
+	case *sql.NullTime:
+		if d.Valid {
+			return d.Time
+		}
+	case *[]byte:
+		if *d != nil {
+			return string(*d)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+// DefaultRetriableErrors SQL server error numbers retried when options do not list their own
+var DefaultRetriableErrors = []int32{
+	-2,    // client timeout
+	233,   // connection forcibly closed
+	1205,  // deadlock victim
+	1222,  // lock request timeout
+	4060,  // cannot open database
+	4221,  // login to read-secondary failed during failover
+	10053, // transport-level error
+	10054, // connection reset by peer
+	10060, // network timeout
+	10928, // resource limit reached
+	10929, // resource limit reached
+	18456, // login failed, typically during failover
+	40143, // connection could not be initialized
+	40197, // service error while processing request
+	40501, // service is busy
+	40613, // database is not currently available
+	49918, // not enough resources
+	49919, // too many operations in progress
+	49920, // service is busy
+}
+
+// IsTransient check whether error is transient and the call should be retried
+func IsTransient(err error, numbers []int32) bool {
+	if err == nil {
+		return false
+	}
+	if len(numbers) == 0 {
+		numbers = DefaultRetriableErrors
+	}
+
+	var me mssql.Error
+	if errors.As(err, &me) {
+		for _, n := range numbers {
+			if me.Number == n {
+				return true
+			}
+		}
+		return false
+	}
+
+	var se mssql.StreamError
+	var ne net.Error
+	switch {
+	case errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.As(err, &se),
+		errors.As(err, &ne):
+		return true
+	}
+
+	// Connection errors of the driver are not wrapped
+	msg := strings.ToLower(err.Error())
+	return strings.HasPrefix(msg, "login error") ||
+		strings.Contains(msg, "unable to open tcp connection")
+}
+
+// Retry call fn until it succeeds, fails with permanent error or options limits are reached.
+// Returns number of attempts made and the last error.
+func Retry(ctx context.Context, o *Options, fn func(ctx context.Context) error) (int, error) {
+	attempts := o.RetryAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	interval := time.Duration(o.RetryInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	maxInterval := time.Duration(o.RetryMaxInterval) * time.Millisecond
+	maxElapsed := time.Duration(o.RetryMaxElapsed) * time.Second
+	start := time.Now()
+
+	for n := 1; ; n++ {
+		err := fn(ctx)
+		if err == nil || n >= attempts || !IsTransient(err, o.RetriableErrors) {
+			return n, err
+		}
+
+		// Equal jitter: half of the interval is fixed, half is random
+		d := interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+		if maxElapsed > 0 && time.Since(start)+d > maxElapsed {
+			return n, err
+		}
+		o.logger().Printf("[WARN] Transient SQL server error, attempt %d of %d, retry in %v. %v\n", n, attempts, d, err)
+
+		select {
+		case <-ctx.Done():
+			return n, err
+		case <-time.After(d):
+		}
+
+		interval *= 2
+		if maxInterval > 0 && interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// ErrorNumber return SQL server error number, ok is false if err is not SQL server error
+func ErrorNumber(err error) (number int32, ok bool) {
+	var me mssql.Error
+	if errors.As(err, &me) {
+		return me.Number, true
+	}
+	return 0, false
+}
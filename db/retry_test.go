@@ -0,0 +1,158 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		numbers []int32
+		want    bool
+	}{
+		{"nil", nil, nil, false},
+		{"deadlock victim", mssql.Error{Number: 1205}, nil, true},
+		{"client timeout", mssql.Error{Number: -2}, nil, true},
+		{"service busy", mssql.Error{Number: 40501}, nil, true},
+		{"wrapped deadlock victim", fmt.Errorf("call failed. %w", mssql.Error{Number: 1205}), nil, true},
+		{"constraint violation", mssql.Error{Number: 547}, nil, false},
+		{"configured number", mssql.Error{Number: 547}, []int32{547}, true},
+		{"number not configured", mssql.Error{Number: 1205}, []int32{547}, false},
+		{"stream error", mssql.StreamError{Message: "bad packet"}, nil, true},
+		{"bad connection", driver.ErrBadConn, nil, true},
+		{"deadline exceeded", context.DeadlineExceeded, nil, true},
+		{"canceled", context.Canceled, nil, false},
+		{"eof", io.EOF, nil, true},
+		{"unexpected eof", fmt.Errorf("read. %w", io.ErrUnexpectedEOF), nil, true},
+		{"net error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, nil, true},
+		{"wrapped net error", fmt.Errorf("connect. %w", &net.DNSError{Err: "no such host", Name: "sql"}), nil, true},
+		{"login error", errors.New("Login error: mssql: Login failed for user 'sa'."), nil, true},
+		{"tcp connection", errors.New("Unable to open tcp connection with host '127.0.0.1:1433'"), nil, true},
+		{"no rows", sql.ErrNoRows, nil, false},
+		{"other", errors.New("invalid object name"), nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsTransient(tt.err, tt.numbers); got != tt.want {
+			t.Errorf("%s: IsTransient(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// failing return function failing with errs in turn and succeeding after them
+func failing(errs ...error) (func(ctx context.Context) error, *int) {
+	calls := new(int)
+	return func(ctx context.Context) error {
+		*calls++
+		if *calls <= len(errs) {
+			return errs[*calls-1]
+		}
+		return nil
+	}, calls
+}
+
+func TestRetry(t *testing.T) {
+	transient, permanent := mssql.Error{Number: 1205}, mssql.Error{Number: 547}
+	tests := []struct {
+		name     string
+		attempts int
+		errs     []error
+		n        int
+		err      error
+	}{
+		{"success", 3, nil, 1, nil},
+		{"transient then success", 3, []error{transient, transient}, 3, nil},
+		{"attempts exhausted", 3, []error{transient, transient, transient}, 3, transient},
+		{"permanent", 3, []error{permanent}, 1, permanent},
+		{"transient then permanent", 3, []error{transient, permanent}, 2, permanent},
+		{"single attempt", 0, []error{transient}, 1, transient},
+	}
+	for _, tt := range tests {
+		o := &Options{RetryAttempts: tt.attempts, RetryInterval: 1, Logger: log.New(io.Discard, "", 0)}
+		fn, calls := failing(tt.errs...)
+		n, err := Retry(context.Background(), o, fn)
+		if n != tt.n || *calls != tt.n || err != tt.err {
+			t.Errorf("%s: Retry = %d, %v with %d calls, want %d, %v", tt.name, n, err, *calls, tt.n, tt.err)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	var buf bytes.Buffer
+	o := &Options{RetryAttempts: 5, RetryInterval: 10, RetryMaxInterval: 40, Logger: log.New(&buf, "", 0)}
+	transient := mssql.Error{Number: 1205}
+	fn, _ := failing(transient, transient, transient, transient, transient)
+	if n, _ := Retry(context.Background(), o, fn); n != 5 {
+		t.Fatalf("%d attempts, want 5", n)
+	}
+
+	// Interval is doubled up to max one, delay is between half of interval and interval
+	want := []time.Duration{10, 20, 40, 40}
+	got := regexp.MustCompile(`retry in (\S+)\.`).FindAllStringSubmatch(buf.String(), -1)
+	if len(got) != len(want) {
+		t.Fatalf("%d retries logged, want %d:\n%s", len(got), len(want), buf.String())
+	}
+	for i, m := range got {
+		d, err := time.ParseDuration(m[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		interval := want[i] * time.Millisecond
+		if d < interval/2 || d > interval {
+			t.Errorf("retry %d in %v, want between %v and %v", i+1, d, interval/2, interval)
+		}
+	}
+}
+
+func TestRetryMaxElapsed(t *testing.T) {
+	o := &Options{RetryAttempts: 10, RetryInterval: 4000, RetryMaxElapsed: 1, Logger: log.New(io.Discard, "", 0)}
+	fn, _ := failing(mssql.Error{Number: 1205})
+	start := time.Now()
+	if n, err := Retry(context.Background(), o, fn); n != 1 || err == nil {
+		t.Errorf("Retry = %d, %v, want 1 attempt failed", n, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Retry waited %v beyond max elapsed time", d)
+	}
+}
+
+func TestRetryContextCancel(t *testing.T) {
+	o := &Options{RetryAttempts: 5, RetryInterval: 60000, Logger: log.New(io.Discard, "", 0)}
+	ctx, cancel := context.WithCancel(context.Background())
+	transient := mssql.Error{Number: 1205}
+	calls := 0
+	fn := func(ctx context.Context) error {
+		calls++
+		cancel()
+		return transient
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if n, err := Retry(ctx, o, fn); n != 1 || err != transient {
+			t.Errorf("Retry = %d, %v, want 1, %v", n, err, transient)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Retry doesn't stop on context cancel")
+	}
+	if calls != 1 {
+		t.Errorf("%d calls after cancel, want 1", calls)
+	}
+}
@@ -0,0 +1,213 @@
+package deadletter
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	lj "gopkg.in/natefinch/lumberjack.v2"
+)
+
+type (
+	// Destination type of dead-letter destination
+	Destination int
+
+	// Options options of dead-letter destination
+	Options struct {
+		Enable      bool        `json:"enable,omitempty"`
+		Destination Destination `json:"destination,omitempty"`
+		// Directory to write dead-letter files to
+		Directory string `json:"directory"`
+		// Filename is the name of the JSONL file which will be placed inside the directory
+		Filename string `json:"filename"`
+		// MaxSize the max size in MB of the file before it's rolled
+		MaxSize int `json:"max_size"`
+		// MaxBackups the max number of rolled files to keep
+		MaxBackups int `json:"max_backups"`
+		// MaxAge the max age in days to keep a file
+		MaxAge int `json:"max_age"`
+		// Topic MQTT topic to publish dead letters to
+		Topic string `json:"topic,omitempty"`
+		// Qos of published dead letters
+		Qos byte `json:"qos,omitempty"`
+		// Table SQL server table to insert dead letters into
+		Table string `json:"table,omitempty"`
+		// Timeout of SQL server calls in seconds
+		Timeout int64 `json:"timeout,omitempty"`
+	}
+
+	// Entry failed message
+	Entry struct {
+		Topic     string    `json:"topic"`
+		Payload   string    `json:"payload"`
+		Converted string    `json:"converted,omitempty"`
+		Error     string    `json:"error"`
+		Attempts  int       `json:"attempts"`
+		Received  time.Time `json:"received"`
+		Failed    time.Time `json:"failed"`
+	}
+
+	// Writer dead-letter destination
+	Writer interface {
+		Write(e *Entry) error
+		Close() error
+	}
+
+	// PublishFunc publish payload to MQTT topic
+	PublishFunc func(topic string, qos byte, payload []byte) error
+
+	fileWriter struct {
+		mu   sync.Mutex
+		l    *lj.Logger
+		lock string
+	}
+
+	mqttWriter struct {
+		o       *Options
+		publish PublishFunc
+	}
+
+	sqlWriter struct {
+		o  *Options
+		db *sql.DB
+	}
+)
+
+const (
+	// FileDestination Запись в ротируемый JSONL файл
+	FileDestination Destination = iota
+	// MqttDestination Публикация в MQTT топик
+	MqttDestination
+	// SQLDestination Запись в таблицу SQL сервера
+	SQLDestination
+)
+
+var (
+	toStringDestination = map[Destination]string{
+		FileDestination: "file",
+		MqttDestination: "mqtt",
+		SQLDestination:  "sql",
+	}
+
+	toIDDestination = map[string]Destination{
+		"file": FileDestination,
+		"mqtt": MqttDestination,
+		"sql":  SQLDestination,
+	}
+)
+
+func (s Destination) String() string {
+	return toStringDestination[s]
+}
+
+// MarshalJSON marshals the enum as a quoted json string
+func (s Destination) MarshalJSON() ([]byte, error) {
+	buffer := bytes.NewBufferString(`"`)
+	buffer.WriteString(toStringDestination[s])
+	buffer.WriteString(`"`)
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON unmashals a quoted json string to the enum value
+func (s *Destination) UnmarshalJSON(b []byte) error {
+	var j string
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	// Note that if the string cannot be found then it will be set to the zero value, 'file' in this case.
+	*s = toIDDestination[j]
+	return nil
+}
+
+// New return writer of configured destination.
+// SQL table must have the following columns:
+//
+//	CREATE TABLE dbo.gscltmsd_dead_letter (
+//		id          bigint IDENTITY(1,1) PRIMARY KEY,
+//		topic       nvarchar(1024) NOT NULL,
+//		payload     nvarchar(max) NULL,
+//		converted   nvarchar(max) NULL,
+//		error       nvarchar(max) NULL,
+//		attempts    int NOT NULL,
+//		received_at datetime2 NOT NULL,
+//		failed_at   datetime2 NOT NULL
+//	)
+func New(o *Options, publish PublishFunc, db *sql.DB) (Writer, error) {
+	switch o.Destination {
+	case MqttDestination:
+		return &mqttWriter{o: o, publish: publish}, nil
+	case SQLDestination:
+		return &sqlWriter{o: o, db: db}, nil
+	}
+
+	if err := os.MkdirAll(o.Directory, 0744); err != nil {
+		return nil, err
+	}
+	// Reinject must not rewrite the file while it's written
+	if err := lock(lockName(o)); err != nil {
+		return nil, err
+	}
+	return &fileWriter{
+		lock: lockName(o),
+		l: &lj.Logger{
+			Filename:   path.Join(o.Directory, o.Filename),
+			MaxBackups: o.MaxBackups, // files
+			MaxSize:    o.MaxSize,    // megabytes
+			MaxAge:     o.MaxAge,     // days
+		},
+	}, nil
+}
+
+func (w *fileWriter) Write(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.l.Write(b)
+	return err
+}
+
+func (w *fileWriter) Close() error {
+	err := w.l.Close()
+	if uerr := unlock(w.lock); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+func (w *mqttWriter) Write(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return w.publish(w.o.Topic, w.o.Qos, b)
+}
+
+func (w *mqttWriter) Close() error {
+	return nil
+}
+
+func (w *sqlWriter) Write(e *Entry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(w.o.Timeout)*time.Second)
+	defer cancel()
+
+	_, err := w.db.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (topic, payload, converted, error, attempts, received_at, failed_at) VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7)",
+		w.o.Table), e.Topic, e.Payload, e.Converted, e.Error, e.Attempts, e.Received, e.Failed)
+	return err
+}
+
+func (w *sqlWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,62 @@
+package deadletter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockName return name of lock file of dead-letter file, it's held by service writing the file
+// and by reinject rewriting it
+func lockName(o *Options) string {
+	return path.Join(o.Directory, o.Filename+".lock")
+}
+
+// lock create lock file with id of current process. Lock left by process which is not running anymore is taken over.
+func lock(name string) error {
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.WriteString(strconv.Itoa(os.Getpid()))
+			f.Close()
+			return err
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		// Process id of container entry point is the same after restart
+		if err == nil && pid != os.Getpid() && running(pid) {
+			return fmt.Errorf("dead-letter file is in use by process %d, lock \"%s\"", pid, name)
+		}
+		// Stale lock of crashed process
+		if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("can't take lock \"%s\"", name)
+}
+
+func unlock(name string) error {
+	return os.Remove(name)
+}
+
+// running check whether process exists
+func running(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Windows finds existing processes only and can't send signal 0
+	return runtime.GOOS == "windows" || p.Signal(syscall.Signal(0)) == nil
+}
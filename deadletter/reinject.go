@@ -0,0 +1,177 @@
+package deadletter
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotSupported destination can't be read back
+var ErrNotSupported = errors.New("reinject is not supported for this dead-letter destination")
+
+// Reinject pass dead letters to fn in order, entries accepted by fn are removed from destination.
+// Returns number of reinjected and still failed entries.
+func Reinject(o *Options, db *sql.DB, fn func(e *Entry) error) (ok int, failed int, err error) {
+	switch o.Destination {
+	case FileDestination:
+		return reinjectFiles(o, fn)
+	case SQLDestination:
+		return reinjectTable(o, db, fn)
+	}
+	return 0, 0, ErrNotSupported
+}
+
+// reinjectFiles process current file and its rotated backups, oldest first.
+// Running service appends to the file, so reinject refuses to run until it's stopped.
+func reinjectFiles(o *Options, fn func(e *Entry) error) (ok int, failed int, err error) {
+	if err = lock(lockName(o)); err != nil {
+		return 0, 0, fmt.Errorf("stop service before reinject. %v", err)
+	}
+	defer unlock(lockName(o))
+
+	ext := filepath.Ext(o.Filename)
+	prefix := strings.TrimSuffix(o.Filename, ext)
+
+	files, err := ioutil.ReadDir(o.Directory)
+	if err != nil {
+		return 0, 0, err
+	}
+	var names []string
+	for _, f := range files {
+		// Backups are named <prefix>-<timestamp><ext> and sort before the current file
+		if !f.IsDir() && strings.HasPrefix(f.Name(), prefix) && strings.HasSuffix(f.Name(), ext) {
+			names = append(names, filepath.Join(o.Directory, f.Name()))
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		n, m, err := reinjectFile(name, fn)
+		ok += n
+		failed += m
+		if err != nil {
+			return ok, failed, err
+		}
+	}
+	return ok, failed, nil
+}
+
+// reinjectFile rewrite file keeping only entries rejected again
+func reinjectFile(name string, fn func(e *Entry) error) (ok int, failed int, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var rest []byte
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64<<20)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		e := new(Entry)
+		if err = json.Unmarshal(line, e); err != nil {
+			log.Printf("[WARN] Can't decode dead letter in \"%s\", kept. %v\n", name, err)
+			rest = append(append(rest, line...), '\n')
+			failed++
+			continue
+		}
+		if err = fn(e); err != nil {
+			retried(e, err)
+			b, _ := json.Marshal(e)
+			rest = append(append(rest, b...), '\n')
+			failed++
+			continue
+		}
+		ok++
+	}
+	err = sc.Err()
+	f.Close()
+	if err != nil {
+		return ok, failed, err
+	}
+
+	if len(rest) == 0 {
+		return ok, failed, os.Remove(name)
+	}
+	if err = ioutil.WriteFile(name+".tmp", rest, 0644); err != nil {
+		return ok, failed, err
+	}
+	return ok, failed, os.Rename(name+".tmp", name)
+}
+
+// reinjectTable process table rows in insertion order
+func reinjectTable(o *Options, db *sql.DB, fn func(e *Entry) error) (ok int, failed int, err error) {
+	type row struct {
+		id int64
+		e  Entry
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.Timeout)*time.Second)
+	rs, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT id, topic, ISNULL(payload, ''), ISNULL(converted, ''), ISNULL(error, ''), attempts, received_at, failed_at FROM %s ORDER BY id",
+		o.Table))
+	if err != nil {
+		cancel()
+		return 0, 0, err
+	}
+	var rows []*row
+	for rs.Next() {
+		r := new(row)
+		if err = rs.Scan(&r.id, &r.e.Topic, &r.e.Payload, &r.e.Converted, &r.e.Error,
+			&r.e.Attempts, &r.e.Received, &r.e.Failed); err != nil {
+			break
+		}
+		rows = append(rows, r)
+	}
+	if err == nil {
+		err = rs.Err()
+	}
+	rs.Close()
+	cancel()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, r := range rows {
+		if ferr := fn(&r.e); ferr != nil {
+			retried(&r.e, ferr)
+			err = exec(o, db, fmt.Sprintf(
+				"UPDATE %s SET error = @p1, attempts = @p2, failed_at = @p3 WHERE id = @p4", o.Table),
+				r.e.Error, r.e.Attempts, r.e.Failed, r.id)
+			failed++
+		} else {
+			err = exec(o, db, fmt.Sprintf("DELETE FROM %s WHERE id = @p1", o.Table), r.id)
+			ok++
+		}
+		if err != nil {
+			return ok, failed, err
+		}
+	}
+	return ok, failed, nil
+}
+
+func exec(o *Options, db *sql.DB, query string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.Timeout)*time.Second)
+	defer cancel()
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func retried(e *Entry, err error) {
+	e.Error = err.Error()
+	e.Attempts++
+	e.Failed = time.Now()
+}
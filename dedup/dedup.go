@@ -0,0 +1,228 @@
+package dedup
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Options options of duplicate message suppression
+	Options struct {
+		Enable bool `json:"enable,omitempty"`
+		// KeyField dot separated path of JSON field with message id, topic and payload hash is used if empty
+		KeyField string `json:"key_field,omitempty"`
+		// Window time in seconds a message is remembered for
+		Window int64 `json:"window"`
+		// MaxEntries max number of remembered messages, the oldest are forgotten first
+		MaxEntries int `json:"max_entries"`
+		// File to keep remembered messages in across restarts, not persisted if empty
+		File string `json:"file,omitempty"`
+		// SaveInterval interval in seconds remembered messages are saved to file at, saved on shutdown only if 0
+		SaveInterval int64 `json:"save_interval,omitempty"`
+	}
+
+	// Key identity of message
+	Key [sha256.Size]byte
+
+	// Filter remembers recently seen messages
+	Filter struct {
+		o          *Options
+		mu         sync.Mutex
+		entries    map[Key]*list.Element
+		order      *list.List // oldest first
+		suppressed uint64
+	}
+
+	entry struct {
+		key     Key
+		expires time.Time
+	}
+)
+
+// New return new filter, remembered messages are loaded from file if configured
+func New(o *Options) (*Filter, error) {
+	f := &Filter{
+		o:       o,
+		entries: make(map[Key]*list.Element),
+		order:   list.New(),
+	}
+	if len(o.File) > 0 {
+		if err := f.load(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Key return identity of message
+func (f *Filter) Key(topic string, payload []byte) Key {
+	// Numbers are kept as written, float64 would make big integers equal
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil || d.More() {
+		return hash(topic, payload)
+	}
+
+	if len(f.o.KeyField) > 0 {
+		id := v
+		for _, k := range strings.Split(f.o.KeyField, ".") {
+			m, ok := id.(map[string]interface{})
+			if !ok {
+				id = nil
+				break
+			}
+			id = m[k]
+		}
+		if id != nil {
+			return hash(topic, []byte(fmt.Sprint(id)))
+		}
+	}
+
+	// Marshal sorts map keys, so equal documents give equal bytes
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return hash(topic, payload)
+	}
+	return hash(topic, canonical)
+}
+
+// Seen check whether message was seen within the window and remember it otherwise
+func (f *Filter) Seen(k Key) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.expire(now)
+
+	if _, ok := f.entries[k]; ok {
+		f.suppressed++
+		return true
+	}
+	f.add(k, now.Add(time.Duration(f.o.Window)*time.Second))
+	return false
+}
+
+// Forget remove message, so it is not treated as duplicate when delivered again
+func (f *Filter) Forget(k Key) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if e, ok := f.entries[k]; ok {
+		f.order.Remove(e)
+		delete(f.entries, k)
+	}
+}
+
+// Suppressed return number of suppressed duplicates
+func (f *Filter) Suppressed() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.suppressed
+}
+
+// Close save remembered messages to file if configured
+func (f *Filter) Close() error {
+	return f.Save()
+}
+
+// Save write remembered messages to file if configured, so they survive a crash
+func (f *Filter) Save() error {
+	if len(f.o.File) <= 0 {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.expire(time.Now())
+	var sb strings.Builder
+	for e := f.order.Front(); e != nil; e = e.Next() {
+		en := e.Value.(*entry)
+		fmt.Fprintf(&sb, "%s %d\n", hex.EncodeToString(en.key[:]), en.expires.Unix())
+	}
+
+	if err := os.MkdirAll(filepath.Dir(f.o.File), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(f.o.File+".tmp", []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.o.File+".tmp", f.o.File)
+}
+
+// add remember key, must be called with lock held
+func (f *Filter) add(k Key, expires time.Time) {
+	f.entries[k] = f.order.PushBack(&entry{key: k, expires: expires})
+	for f.o.MaxEntries > 0 && len(f.entries) > f.o.MaxEntries {
+		f.removeOldest()
+	}
+}
+
+// expire forget messages out of window, must be called with lock held
+func (f *Filter) expire(now time.Time) {
+	for e := f.order.Front(); e != nil && !e.Value.(*entry).expires.After(now); e = f.order.Front() {
+		f.removeOldest()
+	}
+}
+
+func (f *Filter) removeOldest() {
+	e := f.order.Front()
+	f.order.Remove(e)
+	delete(f.entries, e.Value.(*entry).key)
+}
+
+// load read remembered messages saved by Close
+func (f *Filter) load() error {
+	fd, err := os.Open(f.o.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	now := time.Now()
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		var (
+			s   string
+			exp int64
+			k   Key
+		)
+		if _, err := fmt.Sscan(sc.Text(), &s, &exp); err != nil {
+			continue
+		}
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != len(k) {
+			continue
+		}
+		copy(k[:], b)
+		if t := time.Unix(exp, 0); t.After(now) {
+			f.add(k, t)
+		}
+	}
+	return sc.Err()
+}
+
+func hash(topic string, data []byte) Key {
+	h := sha256.New()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(data)
+	var k Key
+	copy(k[:], h.Sum(nil))
+	return k
+}
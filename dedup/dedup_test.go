@@ -0,0 +1,185 @@
+package dedup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newFilter(t *testing.T, o *Options) *Filter {
+	t.Helper()
+	f, err := New(o)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return f
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		keyField string
+		a, b     string
+		equal    bool
+	}{
+		{"same payload", "", `{"id":1,"v":2}`, `{"id":1,"v":2}`, true},
+		{"canonical key order", "", `{"id":1,"v":{"x":1,"y":2}}`, `{ "v" : {"y":2,"x":1}, "id":1 }`, true},
+		{"different payload", "", `{"id":1,"v":2}`, `{"id":1,"v":3}`, false},
+		{"big integers", "", `{"id":9007199254740993}`, `{"id":9007199254740992}`, false},
+		{"number as written", "", `{"v":1.0}`, `{"v":1}`, false},
+		{"not json", "", `abc`, `abc`, true},
+		{"not json differs", "", `abc`, `abd`, false},
+		{"trailing data", "", `{"id":1} {"id":2}`, `{"id":1} {"id":3}`, false},
+		{"key field", "meta.id", `{"meta":{"id":"a"},"v":1}`, `{"meta":{"id":"a"},"v":2}`, true},
+		{"key field differs", "meta.id", `{"meta":{"id":"a"},"v":1}`, `{"meta":{"id":"b"},"v":1}`, false},
+		{"key field big integers", "id", `{"id":9007199254740993}`, `{"id":9007199254740992}`, false},
+		{"key field missing", "meta.id", `{"id":"a","v":1}`, `{"id":"a","v":2}`, false},
+		{"key field missing same payload", "meta.id", `{"id":"a","v":1}`, `{"v":1,"id":"a"}`, true},
+	}
+	for _, tt := range tests {
+		f := newFilter(t, &Options{KeyField: tt.keyField})
+		a, b := f.Key("meter/1", []byte(tt.a)), f.Key("meter/1", []byte(tt.b))
+		if (a == b) != tt.equal {
+			t.Errorf("%s: keys of %s and %s equal = %v, want %v", tt.name, tt.a, tt.b, a == b, tt.equal)
+		}
+	}
+
+	f := newFilter(t, &Options{KeyField: "id"})
+	if f.Key("meter/1", []byte(`{"id":1}`)) == f.Key("meter/2", []byte(`{"id":1}`)) {
+		t.Error("keys of different topics are equal")
+	}
+}
+
+func TestSeen(t *testing.T) {
+	f := newFilter(t, &Options{Window: 60})
+	k := f.Key("meter/1", []byte(`{"id":1}`))
+
+	if f.Seen(k) {
+		t.Fatal("first message seen")
+	}
+	if !f.Seen(k) || !f.Seen(k) {
+		t.Fatal("duplicate not seen")
+	}
+	if n := f.Suppressed(); n != 2 {
+		t.Errorf("Suppressed() = %d, want 2", n)
+	}
+}
+
+func TestWindowExpiry(t *testing.T) {
+	f := newFilter(t, &Options{Window: 60})
+	old, recent := Key{1}, Key{2}
+	f.add(old, time.Now().Add(-time.Second))
+	f.add(recent, time.Now().Add(time.Minute))
+
+	if f.Seen(old) {
+		t.Error("message out of window seen")
+	}
+	if !f.Seen(recent) {
+		t.Error("message within window not seen")
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	f := newFilter(t, &Options{Window: 60, MaxEntries: 2})
+	for _, k := range []Key{{1}, {2}, {3}} {
+		f.Seen(k)
+	}
+
+	if len(f.entries) != 2 || f.order.Len() != 2 {
+		t.Fatalf("%d entries remembered, want 2", len(f.entries))
+	}
+	// Oldest one was evicted, seeing it again evicts the next oldest
+	if f.Seen(Key{1}) {
+		t.Error("evicted message seen")
+	}
+	if !f.Seen(Key{3}) {
+		t.Error("recent message not seen")
+	}
+}
+
+func TestForget(t *testing.T) {
+	f := newFilter(t, &Options{Window: 60})
+	k := Key{1}
+	f.Seen(k)
+	f.Forget(k)
+	f.Forget(Key{2})
+
+	if f.Seen(k) {
+		t.Error("forgotten message seen")
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := &Options{Window: 60, File: filepath.Join(dir, "state", "dedup.dat")}
+	f := newFilter(t, o)
+	f.Seen(Key{1})
+	f.Seen(Key{2})
+	f.add(Key{3}, time.Now().Add(-time.Second))
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Directory is traversable by others, reference one gets the same umask
+	if err := os.Mkdir(filepath.Join(dir, "ref"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ref, _ := os.Stat(filepath.Join(dir, "ref"))
+	fi, err := os.Stat(filepath.Dir(o.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != ref.Mode().Perm() {
+		t.Errorf("directory mode %v, want %v", fi.Mode().Perm(), ref.Mode().Perm())
+	}
+
+	f = newFilter(t, o)
+	if len(f.entries) != 2 {
+		t.Errorf("%d entries loaded, want 2", len(f.entries))
+	}
+	if !f.Seen(Key{1}) || !f.Seen(Key{2}) {
+		t.Error("saved message not seen after load")
+	}
+	if f.Seen(Key{3}) {
+		t.Error("expired message seen after load")
+	}
+}
+
+func TestLoadMissingAndCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := &Options{Window: 60, File: filepath.Join(dir, "dedup.dat")}
+	if f := newFilter(t, o); len(f.entries) != 0 {
+		t.Errorf("%d entries loaded from missing file", len(f.entries))
+	}
+
+	f := newFilter(t, o)
+	f.Seen(Key{1})
+	if err := f.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	data, err := ioutil.ReadFile(o.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append([]byte("garbage\nzz 1\n0102 99999999999\n"), data...)
+	if err := ioutil.WriteFile(o.File, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f = newFilter(t, o)
+	if len(f.entries) != 1 || !f.Seen(Key{1}) {
+		t.Errorf("%d entries loaded, want the single valid one", len(f.entries))
+	}
+}
@@ -5,5 +5,6 @@ go 1.16
 require (
 	github.com/denisenkom/go-mssqldb v0.10.0
 	github.com/eclipse/paho.mqtt.golang v1.3.5
+	github.com/golang-sql/civil v0.0.0-20190719163853-cb61b32ac6fe
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
@@ -0,0 +1,63 @@
+package httpsrv
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+type (
+	// Options options of embedded HTTP server
+	Options struct {
+		Enable bool `json:"enable,omitempty"`
+		// Listen address of server, e.g. ":8080"
+		Listen string `json:"listen"`
+		// ErrorWindow period in seconds the SQL server error rate is calculated over
+		ErrorWindow int64 `json:"error_window,omitempty"`
+		// MaxErrorRate max share of failed SQL server calls within window for the service to be ready, 0..1
+		MaxErrorRate float64 `json:"max_error_rate,omitempty"`
+	}
+
+	// Server embedded HTTP server
+	Server struct {
+		mux *http.ServeMux
+		srv *http.Server
+	}
+)
+
+// New return new server, register handlers with Handle and call Start
+func New(o *Options) *Server {
+	mux := http.NewServeMux()
+	return &Server{
+		mux: mux,
+		srv: &http.Server{
+			Addr:         o.Listen,
+			Handler:      mux,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Handle register handler for pattern
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start start listening in background
+func (s *Server) Start() {
+	go func() {
+		log.Printf("[INFO] HTTP server listening on \"%s\"\n", s.srv.Addr)
+		if err := s.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("[ERROR] HTTP server stopped. %v\n", err)
+		}
+	}()
+}
+
+// Shutdown stop server waiting for active requests up to timeout
+func (s *Server) Shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
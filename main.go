@@ -19,9 +19,11 @@ func main() {
 		err            error
 		configpath     string
 		opt            *service.Options
+		reinject       bool
 	)
 
 	flag.StringVar(&configpath, "c", "", "full path to configuration json `file`")
+	flag.BoolVar(&reinject, "reinject", false, "send dead-lettered messages to SQL server entry point again and exit")
 	flag.Parse()
 
 	filename = filepath.Base(os.Args[0])
@@ -40,11 +42,23 @@ func main() {
 	// configpath = "/home/thinker/projects/gscltmsd/example.gscltmsd.json"
 	opt = service.NewOptions()
 	opt.FileLog.Filename = filename + ".log"
+	opt.DeadLetter.Filename = filename + ".deadletter.jsonl"
+	opt.Reject.Filename = filename + ".reject.jsonl"
 	err = opt.Load(configpath)
 	if err != nil {
 		log.Fatalf("[ERROR] Can't load configuration file. %v", err)
 	}
 
-	svc := service.New(opt)
+	if reinject {
+		if err = service.Reinject(opt); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		return
+	}
+
+	svc, err := service.NewProcess(opt)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
 	svc.Start()
 }
@@ -0,0 +1,306 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// Registry set of metrics exposed in Prometheus text format
+	Registry struct {
+		mu      sync.Mutex
+		metrics []metric
+		// parent registry metrics are added to, constant labels are added to all of them
+		parent      *Registry
+		constNames  []string
+		constValues []string
+	}
+
+	metric interface {
+		desc() (name, help, typ string)
+		write(w *bufio.Writer)
+	}
+
+	// CounterVec counter partitioned by labels
+	CounterVec struct {
+		name   string
+		help   string
+		labels []string
+		consts []string
+		mu     sync.Mutex
+		values map[string]*sample
+	}
+
+	// HistogramVec histogram partitioned by labels
+	HistogramVec struct {
+		name    string
+		help    string
+		labels  []string
+		consts  []string
+		buckets []float64
+		mu      sync.Mutex
+		values  map[string]*histogram
+	}
+
+	funcMetric struct {
+		name   string
+		help   string
+		typ    string
+		labels []string
+		values []string
+		fn     func() float64
+	}
+
+	sample struct {
+		labels []string
+		value  float64
+	}
+
+	histogram struct {
+		labels []string
+		counts []uint64
+		count  uint64
+		sum    float64
+	}
+)
+
+// DefBuckets default histogram buckets in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// NewRegistry return empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// With return registry adding its metrics to r with constant label.
+// Metrics of the same name registered through several such registries are exposed as one metric.
+func (r *Registry) With(name, value string) *Registry {
+	return &Registry{
+		parent:      r,
+		constNames:  append(append([]string(nil), r.constNames...), name),
+		constValues: append(append([]string(nil), r.constValues...), value),
+	}
+}
+
+// Counter register counter with label names
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: r.labelNames(labels), consts: r.constValues,
+		values: make(map[string]*sample)}
+	r.add(c)
+	return c
+}
+
+// Histogram register histogram with upper bounds of buckets and label names
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: r.labelNames(labels), consts: r.constValues,
+		buckets: buckets, values: make(map[string]*histogram)}
+	r.add(h)
+	return h
+}
+
+// GaugeFunc register gauge whose value is read by fn on scrape
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.add(&funcMetric{name: name, help: help, typ: "gauge", labels: r.constNames, values: r.constValues, fn: fn})
+}
+
+// CounterFunc register counter whose value is read by fn on scrape
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.add(&funcMetric{name: name, help: help, typ: "counter", labels: r.constNames, values: r.constValues, fn: fn})
+}
+
+// ServeHTTP write all metrics in Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	// Samples of one metric must be written as a single group
+	var names []string
+	groups := make(map[string][]metric)
+	for _, m := range metrics {
+		name, _, _ := m.desc()
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], m)
+	}
+	for _, name := range names {
+		_, help, typ := groups[name][0].desc()
+		header(bw, name, help, typ)
+		for _, m := range groups[name] {
+			m.write(bw)
+		}
+	}
+	bw.Flush()
+}
+
+func (r *Registry) add(m metric) {
+	if r.parent != nil {
+		r.parent.add(m)
+		return
+	}
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// labelNames return constant label names followed by names
+func (r *Registry) labelNames(names []string) []string {
+	if len(r.constNames) == 0 {
+		return names
+	}
+	return append(append([]string(nil), r.constNames...), names...)
+}
+
+// Inc increment counter for label values
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add add v to counter for label values
+func (c *CounterVec) Add(v float64, values ...string) {
+	if len(c.consts) > 0 {
+		values = append(append([]string(nil), c.consts...), values...)
+	}
+	key := strings.Join(values, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.values[key]
+	if !ok {
+		s = &sample{labels: values}
+		c.values[key] = s
+	}
+	s.value += v
+}
+
+func (c *CounterVec) desc() (string, string, string) {
+	return c.name, c.help, "counter"
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels(c.labels, s.labels, "", ""), formatFloat(s.value))
+	}
+}
+
+// Observe add observation to histogram for label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	if len(h.consts) > 0 {
+		values = append(append([]string(nil), h.consts...), values...)
+	}
+	key := strings.Join(values, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogram{labels: values, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) desc() (string, string, string) {
+	return h.name, h.help, "histogram"
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.values[key]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels(h.labels, s.labels, "le", formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels(h.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels(h.labels, s.labels, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels(h.labels, s.labels, "", ""), s.count)
+	}
+}
+
+func (f *funcMetric) desc() (string, string, string) {
+	return f.name, f.help, f.typ
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "%s%s %s\n", f.name, labels(f.labels, f.values, "", ""), formatFloat(f.fn()))
+}
+
+func header(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// labels format label set, extra label is appended if name is not empty
+func labels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && len(extraName) == 0 {
+		return ""
+	}
+	esc := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		sb.WriteString(n + `="` + esc.Replace(v) + `"`)
+	}
+	if len(extraName) > 0 {
+		if len(names) > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(extraName + `="` + extraValue + `"`)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
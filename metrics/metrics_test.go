@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	return rec.Body.String()
+}
+
+func expect(t *testing.T, got string, want ...string) {
+	t.Helper()
+	if w := strings.Join(want, "\n") + "\n"; got != w {
+		t.Errorf("exposition\n%s\nwant\n%s", got, w)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "Requests by route.\nSecond line \\ backslash.", "route")
+	c.Inc("b")
+	c.Add(2.5, "a")
+	c.Inc("b")
+	c.Inc(`q"u\o` + "\n")
+	r.Counter("reconnects_total", "Reconnects.").Inc()
+
+	expect(t, scrape(t, r),
+		`# HELP requests_total Requests by route.\nSecond line \\ backslash.`,
+		`# TYPE requests_total counter`,
+		`requests_total{route="a"} 2.5`,
+		`requests_total{route="b"} 2`,
+		`requests_total{route="q\"u\\o\n"} 1`,
+		`# HELP reconnects_total Reconnects.`,
+		`# TYPE reconnects_total counter`,
+		`reconnects_total 1`,
+	)
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.Histogram("call_seconds", "Call duration.", []float64{.1, 1}, "procedure")
+	h.Observe(0.05, "p")
+	h.Observe(0.5, "p")
+	h.Observe(2, "p")
+
+	expect(t, scrape(t, r),
+		`# HELP call_seconds Call duration.`,
+		`# TYPE call_seconds histogram`,
+		`call_seconds_bucket{procedure="p",le="0.1"} 1`,
+		`call_seconds_bucket{procedure="p",le="1"} 2`,
+		`call_seconds_bucket{procedure="p",le="+Inf"} 3`,
+		`call_seconds_sum{procedure="p"} 2.55`,
+		`call_seconds_count{procedure="p"} 3`,
+	)
+}
+
+func TestConstLabels(t *testing.T) {
+	r := NewRegistry()
+	// Metrics of the same name from several services are exposed as one group
+	for _, name := range []string{"heat", "water"} {
+		sr := r.With("service", name)
+		sr.Counter("received_total", "Received.", "route").Inc("meters")
+		v := float64(len(name))
+		sr.GaugeFunc("queue_length", "Queue length.", func() float64 { return v })
+	}
+	r.CounterFunc("uptime_seconds_total", "Uptime.", func() float64 { return math.Inf(1) })
+	r.GaugeFunc("ratio", "Ratio.", func() float64 { return math.NaN() })
+
+	expect(t, scrape(t, r),
+		`# HELP received_total Received.`,
+		`# TYPE received_total counter`,
+		`received_total{service="heat",route="meters"} 1`,
+		`received_total{service="water",route="meters"} 1`,
+		`# HELP queue_length Queue length.`,
+		`# TYPE queue_length gauge`,
+		`queue_length{service="heat"} 4`,
+		`queue_length{service="water"} 5`,
+		`# HELP uptime_seconds_total Uptime.`,
+		`# TYPE uptime_seconds_total counter`,
+		`uptime_seconds_total +Inf`,
+		`# HELP ratio Ratio.`,
+		`# TYPE ratio gauge`,
+		`ratio NaN`,
+	)
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -19,22 +20,34 @@ type (
 
 	// Options options of mqtt server
 	Options struct {
-		Host                 string                `json:"host"`
-		Port                 uint16                `json:"port,omitempty"`
-		Ssl                  bool                  `json:"ssl,omitempty"`
-		AuthType             AuthType              `json:"auth_type,omitempty"`
-		Username             string                `json:"username,omitempty"`
-		Password             string                `json:"password,omitempty"`
-		CACert               string                `json:"ca_cert,omitempty"`
-		ClientCert           string                `json:"client_cert,omitempty"`
-		ClientKey            string                `json:"client_key,omitempty"`
-		Insecure             bool                  `json:"insecure,omitempty"`
-		KeepAlive            int64                 `json:"keep_alive,omitempty"`
-		ConnectTimeout       int64                 `json:"connect_timeout,omitempty"`
-		MaxReconnectInterval int64                 `json:"max_reconnect_interval,omitempty"`
-		Qos                  byte                  `json:"qos,omitempty"`
-		Topic                string                `json:"topic,omitempty"`
-		OnConnectHandler     mqtt.OnConnectHandler `json:"-"`
+		Host                 string                     `json:"host"`
+		Port                 uint16                     `json:"port,omitempty"`
+		Ssl                  bool                       `json:"ssl,omitempty"`
+		AuthType             AuthType                   `json:"auth_type,omitempty"`
+		Username             string                     `json:"username,omitempty"`
+		Password             string                     `json:"password,omitempty"`
+		CACert               string                     `json:"ca_cert,omitempty"`
+		ClientCert           string                     `json:"client_cert,omitempty"`
+		ClientKey            string                     `json:"client_key,omitempty"`
+		Insecure             bool                       `json:"insecure,omitempty"`
+		KeepAlive            int64                      `json:"keep_alive,omitempty"`
+		ConnectTimeout       int64                      `json:"connect_timeout,omitempty"`
+		MaxReconnectInterval int64                      `json:"max_reconnect_interval,omitempty"`
+		Qos                  byte                       `json:"qos,omitempty"`
+		Topic                string                     `json:"topic,omitempty"`
+		TopicTemplate        string                     `json:"topic_template,omitempty"`
+		ClientID             string                     `json:"client_id,omitempty"`
+		CleanSession         bool                       `json:"clean_session"`
+		StoreDir             string                     `json:"store_dir,omitempty"`
+		AsyncHandlers        bool                       `json:"-"`
+		OnConnectHandler     mqtt.OnConnectHandler      `json:"-"`
+		OnConnectionLost     mqtt.ConnectionLostHandler `json:"-"`
+		// OnMessage handler of messages not matched by routes added to client
+		OnMessage mqtt.MessageHandler `json:"-"`
+		// Name of pipeline the client belongs to, added to generated client ID
+		Name string `json:"-"`
+		// Logger of client messages, standard logger is used if nil
+		Logger *log.Logger `json:"-"`
 	}
 )
 
@@ -85,8 +98,8 @@ func (s *AuthType) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-// NewClient
-func NewClient(o *Options) mqtt.Client {
+// NewClient return configured client, call Connect to connect it
+func NewClient(o *Options) (mqtt.Client, error) {
 	var (
 		err       error
 		certPool  *x509.CertPool
@@ -104,11 +117,11 @@ func NewClient(o *Options) mqtt.Client {
 		pemCerts, err = ioutil.ReadFile(o.CACert)
 
 		if err != nil {
-			log.Fatalf("[ERROR] Can't connect to MQTT server. %v\n", err)
+			return nil, err
 		}
 
 		if !certPool.AppendCertsFromPEM(pemCerts) {
-			log.Fatalf("[ERROR] Can't connect to MQTT server. %v\n", err)
+			return nil, fmt.Errorf("no certificates found in \"%s\"", o.CACert)
 		}
 
 		tlsConfig = &tls.Config{
@@ -123,7 +136,7 @@ func NewClient(o *Options) mqtt.Client {
 			// Import client certificate/key pair
 			cltCert, err = tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
 			if err != nil {
-				log.Fatalf("[ERROR] Can't connect to MQTT server. %v\n", err)
+				return nil, err
 			}
 			tlsConfig.Certificates = []tls.Certificate{cltCert}
 		}
@@ -146,23 +159,57 @@ func NewClient(o *Options) mqtt.Client {
 	opts.SetConnectTimeout(time.Duration(o.ConnectTimeout) * time.Second)
 	opts.SetMaxReconnectInterval(time.Duration(o.MaxReconnectInterval) * time.Second)
 	opts.SetAutoReconnect(true)
-	opts.SetCleanSession(true)
+	opts.SetCleanSession(o.CleanSession)
+	// Handlers running in own goroutines may block until message is processed
+	opts.SetOrderMatters(!o.AsyncHandlers)
+
+	clientID := o.ClientID
+	if len(clientID) <= 0 && !o.CleanSession {
+		// Broker keeps session by client ID, so it must be stable across restarts
+		host, _ := os.Hostname()
+		clientID = "gscltmsd-" + host
+		if len(o.Name) > 0 {
+			clientID += "-" + o.Name
+		}
+		o.logger().Printf("[WARN] MQTT client ID is not set for persistent session, using \"%s\"\n", clientID)
+	}
+	opts.SetClientID(clientID)
+
+	if len(o.StoreDir) > 0 {
+		if err = os.MkdirAll(o.StoreDir, 0744); err != nil {
+			return nil, err
+		}
+		opts.SetStore(mqtt.NewFileStore(o.StoreDir))
+	}
+	if !o.CleanSession {
+		opts.SetResumeSubs(true)
+	}
 
 	if o.OnConnectHandler != nil {
 		opts.SetOnConnectHandler(o.OnConnectHandler)
 	} else {
 		opts.SetOnConnectHandler(onConnectHandler)
 	}
-	opts.SetConnectionLostHandler(connectionLostHandler)
-	opts.SetReconnectingHandler(reconnectHandler)
-
-	client := mqtt.NewClient(opts)
-
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("[ERROR] Can't connect to MQTT server. %v\n", token.Error())
+	if o.OnConnectionLost != nil {
+		opts.SetConnectionLostHandler(o.OnConnectionLost)
+	} else {
+		opts.SetConnectionLostHandler(connectionLostHandler)
+	}
+	if o.OnMessage != nil {
+		opts.SetDefaultPublishHandler(o.OnMessage)
 	}
+	opts.SetReconnectingHandler(func(c mqtt.Client, co *mqtt.ClientOptions) {
+		o.logger().Println("[INFO] Reconnect MQTT server...")
+	})
 
-	return client
+	return mqtt.NewClient(opts), nil
+}
+
+// Connect connect client to MQTT server, client reconnects automatically once connected
+func Connect(c mqtt.Client) error {
+	token := c.Connect()
+	token.Wait()
+	return token.Error()
 }
 
 func onConnectHandler(c mqtt.Client) {
@@ -173,6 +220,9 @@ func connectionLostHandler(c mqtt.Client, e error) {
 	log.Printf("[WARN] Connection MQTT server lost: %v\n", e)
 }
 
-func reconnectHandler(c mqtt.Client, o *mqtt.ClientOptions) {
-	log.Println("[INFO] Reconnect MQTT server...")
+func (o *Options) logger() *log.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return log.Default()
 }
@@ -0,0 +1,174 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type (
+	// Options options of outbox of messages published from SQL server to MQTT
+	Options struct {
+		Enable bool `json:"enable,omitempty"`
+		// Table outbox table, used unless fetch procedure is set
+		Table string `json:"table,omitempty"`
+		// FetchProcedure procedure returning pending rows (id, topic, payload, qos, retain), takes @limit
+		FetchProcedure string `json:"fetch_procedure,omitempty"`
+		// MarkProcedure procedure marking row sent or failed, takes @id, @sent and @error
+		MarkProcedure string `json:"mark_procedure,omitempty"`
+		// Interval poll interval in seconds
+		Interval int64 `json:"interval"`
+		// BatchSize max number of rows read in one poll
+		BatchSize int `json:"batch_size"`
+		// Timeout of SQL server calls and publishing in seconds
+		Timeout int64 `json:"timeout,omitempty"`
+	}
+
+	// Row message to publish
+	Row struct {
+		ID      int64
+		Topic   string
+		Payload []byte
+		Qos     byte
+		Retain  bool
+	}
+
+	// PublishFunc publish payload to MQTT topic, returns once broker acknowledged it
+	PublishFunc func(topic string, qos byte, retain bool, payload []byte) error
+
+	// Poller publish pending rows of outbox and mark them sent or failed
+	Poller struct {
+		o       *Options
+		db      *sql.DB
+		publish PublishFunc
+	}
+)
+
+// New return poller of outbox. Outbox table must have the following columns:
+//
+//	CREATE TABLE dbo.gscltmsd_outbox (
+//		id         bigint IDENTITY(1,1) PRIMARY KEY,
+//		topic      nvarchar(1024) NOT NULL,
+//		payload    nvarchar(max) NULL,
+//		qos        tinyint NOT NULL DEFAULT 1,
+//		retain     bit NOT NULL DEFAULT 0,
+//		status     varchar(10) NOT NULL DEFAULT 'pending', -- pending, sent or failed
+//		error      nvarchar(max) NULL,
+//		created_at datetime2 NOT NULL DEFAULT SYSUTCDATETIME(),
+//		sent_at    datetime2 NULL
+//	)
+func New(o *Options, db *sql.DB, publish PublishFunc) *Poller {
+	return &Poller{o: o, db: db, publish: publish}
+}
+
+// Poll publish pending rows in order of id. Row is marked sent once broker acknowledged it, so it's published
+// at least once. Rows which can never be published are marked failed with reason. Poll stops on the first
+// publish or SQL server error leaving the rest pending.
+func (p *Poller) Poll(ctx context.Context) (sent, failed int, err error) {
+	rows, err := p.fetch(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("can't read outbox. %v", err)
+	}
+
+	for _, r := range rows {
+		if reason := validate(r); reason != nil {
+			if err = p.mark(ctx, r.ID, reason); err != nil {
+				return sent, failed, fmt.Errorf("can't mark outbox row %d failed. %v", r.ID, err)
+			}
+			failed++
+			continue
+		}
+
+		if err = p.publish(r.Topic, r.Qos, r.Retain, r.Payload); err != nil {
+			return sent, failed, fmt.Errorf("can't publish outbox row %d to topic \"%s\". %v", r.ID, r.Topic, err)
+		}
+		if err = p.mark(ctx, r.ID, nil); err != nil {
+			return sent, failed, fmt.Errorf("can't mark outbox row %d sent. %v", r.ID, err)
+		}
+		sent++
+	}
+	return sent, failed, nil
+}
+
+// fetch read pending rows
+func (p *Poller) fetch(ctx context.Context) ([]*Row, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.o.Timeout)*time.Second)
+	defer cancel()
+
+	var (
+		rs  *sql.Rows
+		err error
+	)
+	if len(p.o.FetchProcedure) > 0 {
+		rs, err = p.db.QueryContext(ctx, p.o.FetchProcedure, sql.Named("limit", p.o.BatchSize))
+	} else {
+		rs, err = p.db.QueryContext(ctx, fmt.Sprintf(
+			"SELECT TOP (@p1) id, topic, payload, qos, retain FROM %s WHERE status = 'pending' ORDER BY id",
+			p.o.Table), p.o.BatchSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	var rows []*Row
+	for rs.Next() {
+		var (
+			r       Row
+			payload sql.NullString
+			qos     int64
+		)
+		if err = rs.Scan(&r.ID, &r.Topic, &payload, &qos, &r.Retain); err != nil {
+			return nil, err
+		}
+		r.Payload = []byte(payload.String)
+		if qos < 0 || qos > 2 {
+			// Invalid QoS is reported by validate
+			qos = 3
+		}
+		r.Qos = byte(qos)
+		rows = append(rows, &r)
+	}
+	return rows, rs.Err()
+}
+
+// mark mark row sent, or failed with reason
+func (p *Poller) mark(ctx context.Context, id int64, reason error) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.o.Timeout)*time.Second)
+	defer cancel()
+
+	var msg sql.NullString
+	if reason != nil {
+		msg = sql.NullString{String: reason.Error(), Valid: true}
+	}
+
+	var err error
+	switch {
+	case len(p.o.MarkProcedure) > 0:
+		_, err = p.db.ExecContext(ctx, p.o.MarkProcedure,
+			sql.Named("id", id), sql.Named("sent", reason == nil), sql.Named("error", msg))
+	case reason == nil:
+		_, err = p.db.ExecContext(ctx, fmt.Sprintf(
+			"UPDATE %s SET status = 'sent', sent_at = SYSUTCDATETIME(), error = NULL WHERE id = @p1", p.o.Table), id)
+	default:
+		_, err = p.db.ExecContext(ctx, fmt.Sprintf(
+			"UPDATE %s SET status = 'failed', error = @p2 WHERE id = @p1", p.o.Table), id, msg)
+	}
+	return err
+}
+
+// validate return reason row can never be published, nil if it can
+func validate(r *Row) error {
+	switch {
+	case len(r.Topic) <= 0:
+		return errors.New("topic is empty")
+	case strings.ContainsAny(r.Topic, "+#\x00"):
+		return errors.New("topic contains wildcard or null character")
+	case r.Qos > 2:
+		return errors.New("qos must be 0, 1 or 2")
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package pipeline
+
+import (
+	"sync"
+	"time"
+)
+
+// Batcher accumulates items and flushes them by count, size or time
+type Batcher struct {
+	size     int
+	maxBytes int
+	interval time.Duration
+	flush    func(items []interface{})
+	mu       sync.Mutex
+	items    []interface{}
+	bytes    int
+	timer    *time.Timer
+	closed   bool
+	// running flushes in progress, Close waits for them
+	running sync.WaitGroup
+	// Batches are flushed one by one in order they were taken,
+	// next is ticket of the next taken batch, turn is ticket of batch allowed to flush
+	next, turn uint64
+	turnCond   *sync.Cond
+}
+
+// NewBatcher return batcher which calls flush for up to size items or
+// after interval since the first item of batch was added
+func NewBatcher(size int, interval time.Duration, flush func(items []interface{})) *Batcher {
+	b := &Batcher{
+		size:     size,
+		interval: interval,
+		flush:    flush,
+	}
+	b.turnCond = sync.NewCond(&b.mu)
+	return b
+}
+
+// SetMaxBytes flush batch once total size of its items reaches n bytes, unlimited if n is not positive
+func (b *Batcher) SetMaxBytes(n int) {
+	b.mu.Lock()
+	b.maxBytes = n
+	b.mu.Unlock()
+}
+
+// Add append item to the current batch, flushes it in the caller goroutine when full
+func (b *Batcher) Add(item interface{}) {
+	b.AddSized(item, 0)
+}
+
+// AddSized append item of size bytes to the current batch, flushes it in the caller goroutine when full.
+// Item added after Close is flushed immediately.
+func (b *Batcher) AddSized(item interface{}, size int) {
+	b.mu.Lock()
+	b.items = append(b.items, item)
+	b.bytes += size
+	if !b.closed && len(b.items) < b.size && (b.maxBytes <= 0 || b.bytes < b.maxBytes) {
+		if len(b.items) == 1 && b.interval > 0 {
+			b.timer = time.AfterFunc(b.interval, b.Flush)
+		}
+		b.mu.Unlock()
+		return
+	}
+	items, ticket := b.take()
+	b.mu.Unlock()
+
+	b.run(items, ticket)
+}
+
+// Flush send the current batch immediately
+func (b *Batcher) Flush() {
+	b.mu.Lock()
+	items, ticket := b.take()
+	b.mu.Unlock()
+
+	b.run(items, ticket)
+}
+
+// Close stop the timer, send the current batch and wait for all flushes in progress
+func (b *Batcher) Close() {
+	b.mu.Lock()
+	b.closed = true
+	items, ticket := b.take()
+	b.mu.Unlock()
+
+	b.run(items, ticket)
+	b.running.Wait()
+}
+
+// take detach the current batch and return it with its flush ticket, must be called with lock held.
+// Flush of detached batch is counted as running, so Close waits for it.
+func (b *Batcher) take() ([]interface{}, uint64) {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	items := b.items
+	b.items = nil
+	b.bytes = 0
+	if len(items) == 0 {
+		return nil, 0
+	}
+	b.running.Add(1)
+	ticket := b.next
+	b.next++
+	return items, ticket
+}
+
+// run flush items detached by take after the batches taken before them.
+// Timer and size flushes run in different goroutines, so they wait for their turn.
+func (b *Batcher) run(items []interface{}, ticket uint64) {
+	if len(items) == 0 {
+		return
+	}
+	defer b.running.Done()
+
+	b.mu.Lock()
+	for b.turn != ticket {
+		b.turnCond.Wait()
+	}
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.turn++
+		b.turnCond.Broadcast()
+		b.mu.Unlock()
+	}()
+	b.flush(items)
+}
@@ -0,0 +1,150 @@
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flushes records batches flushed by batcher
+type flushes struct {
+	mu      sync.Mutex
+	batches []string
+	running int
+	max     int
+	// block first flush until released
+	started chan struct{}
+	release chan struct{}
+}
+
+func newFlushes() *flushes {
+	return &flushes{started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (f *flushes) flush(items []interface{}) {
+	f.mu.Lock()
+	f.running++
+	if f.running > f.max {
+		f.max = f.running
+	}
+	first := len(f.batches) == 0
+	f.batches = append(f.batches, fmt.Sprint(items...))
+	f.mu.Unlock()
+
+	if first {
+		f.started <- struct{}{}
+		<-f.release
+	}
+
+	f.mu.Lock()
+	f.running--
+	f.mu.Unlock()
+}
+
+func (f *flushes) result() ([]string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.batches...), f.max
+}
+
+func TestBatcherSizeAndBytes(t *testing.T) {
+	f := newFlushes()
+	close(f.release)
+	b := NewBatcher(3, 0, f.flush)
+	b.SetMaxBytes(10)
+
+	for _, s := range []string{"a", "b", "c", "d"} {
+		b.AddSized(s, 1)
+	}
+	b.AddSized("e", 9)
+	b.AddSized("f", 1)
+	b.Close()
+	b.Add("g")
+
+	got, _ := f.result()
+	equal(t, "batches", got, "abc", "de", "f", "g")
+}
+
+func TestBatcherTimer(t *testing.T) {
+	f := newFlushes()
+	close(f.release)
+	b := NewBatcher(10, 20*time.Millisecond, f.flush)
+
+	b.Add("a")
+	b.Add("b")
+	time.Sleep(200 * time.Millisecond)
+	b.Add("c")
+	b.Close()
+
+	got, _ := f.result()
+	equal(t, "batches", got, "ab", "c")
+}
+
+func TestBatcherFlushesInOrder(t *testing.T) {
+	f := newFlushes()
+	b := NewBatcher(2, 10*time.Millisecond, f.flush)
+
+	// Timer flush of the first batch blocks, size flush of the second one must wait for it
+	b.Add("a")
+	<-f.started
+	added := make(chan struct{})
+	go func() {
+		b.Add("b")
+		b.Add("c")
+		close(added)
+	}()
+
+	select {
+	case <-added:
+		t.Fatal("size flush didn't wait for timer flush in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got, _ := f.result(); len(got) != 1 {
+		t.Fatalf("batches %q flushed while the first one is in progress", got)
+	}
+
+	close(f.release)
+	<-added
+	b.Close()
+
+	got, max := f.result()
+	equal(t, "batches", got, "a", "bc")
+	if max != 1 {
+		t.Errorf("%d flushes ran concurrently", max)
+	}
+}
+
+func TestBatcherConcurrentAdds(t *testing.T) {
+	f := newFlushes()
+	close(f.release)
+	b := NewBatcher(7, time.Millisecond, f.flush)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b.Add("x")
+			}
+		}()
+	}
+	wg.Wait()
+	b.Close()
+
+	got, max := f.result()
+	n := 0
+	for _, s := range got {
+		if len(s) > 7 {
+			t.Errorf("batch of %d items, want at most 7", len(s))
+		}
+		n += len(s)
+	}
+	if n != 800 {
+		t.Errorf("%d items flushed, want 800", n)
+	}
+	if max != 1 {
+		t.Errorf("%d flushes ran concurrently", max)
+	}
+}
@@ -0,0 +1,375 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// QueuePolicy behaviour when the queue is full
+	QueuePolicy int
+
+	// OrderBy source of key for sequential processing of messages
+	OrderBy int
+
+	// Options options of message processing pipeline
+	Options struct {
+		// Workers number of concurrent message handlers
+		Workers int `json:"workers"`
+		// QueueSize max number of messages waiting for a worker
+		QueueSize int `json:"queue_size"`
+		// QueuePolicy what to do with a message when the queue is full
+		QueuePolicy QueuePolicy `json:"queue_policy,omitempty"`
+		// MaxInflightBytes max size of payloads queued and being handled
+		MaxInflightBytes int64 `json:"max_inflight_bytes,omitempty"`
+		// AtLeastOnce acknowledge QoS 1 and 2 messages only after they are stored in SQL server or spool
+		AtLeastOnce bool `json:"at_least_once,omitempty"`
+		// OrderBy messages with the same key are processed sequentially
+		OrderBy OrderBy `json:"order_by,omitempty"`
+		// OrderSegment number of topic segment used as key, starting from 1, negative numbers count from the end
+		OrderSegment int `json:"order_segment,omitempty"`
+		// OrderField dot separated path of JSON field used as key
+		OrderField string `json:"order_field,omitempty"`
+	}
+
+	// Job unit of work for the pool
+	Job struct {
+		// Key jobs with the same non-empty key run sequentially in order of submission
+		Key string
+		// Size payload size accounted against MaxInflightBytes
+		Size int
+		// Run called by worker
+		Run func()
+		// Drop called instead of Run when job is dropped by queue policy
+		Drop func()
+	}
+
+	// Pool bounded worker pool
+	Pool struct {
+		o        *Options
+		mu       sync.Mutex
+		cond     *sync.Cond
+		queue    []*Job
+		active   map[string]bool
+		inflight int64
+		closed   bool
+		wg       sync.WaitGroup
+	}
+)
+
+const (
+	// BlockPolicy Блокировать получение сообщений до освобождения очереди
+	BlockPolicy QueuePolicy = iota
+	// DropOldestPolicy Удалять самое старое сообщение в очереди
+	DropOldestPolicy
+	// DropNewestPolicy Удалять новое сообщение
+	DropNewestPolicy
+)
+
+const (
+	// NoOrder Без упорядочивания
+	NoOrder OrderBy = iota
+	// TopicOrder Упорядочивание по топику
+	TopicOrder
+	// SegmentOrder Упорядочивание по сегменту топика
+	SegmentOrder
+	// FieldOrder Упорядочивание по полю JSON
+	FieldOrder
+)
+
+var (
+	toStringQueuePolicy = map[QueuePolicy]string{
+		BlockPolicy:      "block",
+		DropOldestPolicy: "drop_oldest",
+		DropNewestPolicy: "drop_newest",
+	}
+
+	toIDQueuePolicy = map[string]QueuePolicy{
+		"block":       BlockPolicy,
+		"drop_oldest": DropOldestPolicy,
+		"drop_newest": DropNewestPolicy,
+	}
+
+	toStringOrderBy = map[OrderBy]string{
+		NoOrder:      "none",
+		TopicOrder:   "topic",
+		SegmentOrder: "segment",
+		FieldOrder:   "field",
+	}
+
+	toIDOrderBy = map[string]OrderBy{
+		"none":    NoOrder,
+		"topic":   TopicOrder,
+		"segment": SegmentOrder,
+		"field":   FieldOrder,
+	}
+)
+
+func (s QueuePolicy) String() string {
+	return toStringQueuePolicy[s]
+}
+
+// MarshalJSON marshals the enum as a quoted json string
+func (s QueuePolicy) MarshalJSON() ([]byte, error) {
+	buffer := bytes.NewBufferString(`"`)
+	buffer.WriteString(toStringQueuePolicy[s])
+	buffer.WriteString(`"`)
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON unmashals a quoted json string to the enum value
+func (s *QueuePolicy) UnmarshalJSON(b []byte) error {
+	var j string
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	// Note that if the string cannot be found then it will be set to the zero value, 'block' in this case.
+	*s = toIDQueuePolicy[j]
+	return nil
+}
+
+func (s OrderBy) String() string {
+	return toStringOrderBy[s]
+}
+
+// MarshalJSON marshals the enum as a quoted json string
+func (s OrderBy) MarshalJSON() ([]byte, error) {
+	buffer := bytes.NewBufferString(`"`)
+	buffer.WriteString(toStringOrderBy[s])
+	buffer.WriteString(`"`)
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON unmashals a quoted json string to the enum value
+func (s *OrderBy) UnmarshalJSON(b []byte) error {
+	var j string
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	// Note that if the string cannot be found then it will be set to the zero value, 'none' in this case.
+	*s = toIDOrderBy[j]
+	return nil
+}
+
+// Validate check ordering options
+func (o *Options) Validate() error {
+	if o.OrderBy == SegmentOrder && o.OrderSegment == 0 {
+		return errors.New("order_segment must be topic segment number starting from 1, or negative to count from the end")
+	}
+	return nil
+}
+
+// OrderKey return ordering key of message, empty key means no ordering
+func (o *Options) OrderKey(topic string, payload []byte) string {
+	switch o.OrderBy {
+	case TopicOrder:
+		return topic
+	case SegmentOrder:
+		segs := strings.Split(topic, "/")
+		n := o.OrderSegment
+		if n < 0 {
+			n = len(segs) + n + 1
+		}
+		if n >= 1 && n <= len(segs) {
+			return segs[n-1]
+		}
+	case FieldOrder:
+		var v interface{}
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return ""
+		}
+		for _, k := range strings.Split(o.OrderField, ".") {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return ""
+			}
+			v = m[k]
+		}
+		if v != nil {
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+// New return new pool with started workers
+func New(o *Options) *Pool {
+	p := &Pool{o: o, active: make(map[string]bool)}
+	p.cond = sync.NewCond(&p.mu)
+
+	workers := o.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// Submit put job to the queue, returns false if the job was dropped
+func (p *Pool) Submit(j *Job) bool {
+	p.mu.Lock()
+
+	for !p.closed && !p.fits(j) {
+		if p.o.QueuePolicy == DropNewestPolicy {
+			p.mu.Unlock()
+			drop(j)
+			return false
+		}
+		if p.o.QueuePolicy == DropOldestPolicy && len(p.queue) > 0 {
+			old := p.queue[0]
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+			p.inflight -= int64(old.Size)
+			p.mu.Unlock()
+			drop(old)
+			p.mu.Lock()
+			continue
+		}
+		// Block policy, or nothing left to drop while running jobs hold the memory
+		p.cond.Wait()
+	}
+
+	if p.closed {
+		p.mu.Unlock()
+		drop(j)
+		return false
+	}
+
+	p.queue = append(p.queue, j)
+	p.inflight += int64(j.Size)
+	p.mu.Unlock()
+	p.cond.Broadcast()
+	return true
+}
+
+// Len return number of queued jobs
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+// InflightBytes return size of queued and running jobs
+func (p *Pool) InflightBytes() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inflight
+}
+
+// Close stop accepting jobs and wait until queued jobs are done.
+// Jobs still queued after timeout are dropped, running ones are waited for.
+// Zero timeout means no limit. Returns number of dropped jobs.
+func (p *Pool) Close(timeout time.Duration) int {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	if timeout <= 0 {
+		<-done
+		return 0
+	}
+	select {
+	case <-done:
+		return 0
+	case <-time.After(timeout):
+	}
+
+	p.mu.Lock()
+	queue := p.queue
+	p.queue = nil
+	for _, j := range queue {
+		p.inflight -= int64(j.Size)
+	}
+	p.mu.Unlock()
+	p.cond.Broadcast()
+
+	for _, j := range queue {
+		drop(j)
+	}
+	<-done
+	return len(queue)
+}
+
+// fits check queue length and memory limits, must be called with lock held
+func (p *Pool) fits(j *Job) bool {
+	if p.o.QueueSize > 0 && len(p.queue) >= p.o.QueueSize {
+		return false
+	}
+	// A single job larger than the limit is accepted when nothing else is in flight
+	if p.o.MaxInflightBytes > 0 && p.inflight > 0 && p.inflight+int64(j.Size) > p.o.MaxInflightBytes {
+		return false
+	}
+	return true
+}
+
+func (p *Pool) worker() {
+	defer p.wg.Done()
+
+	for {
+		p.mu.Lock()
+		i := p.ready()
+		for i < 0 && !(p.closed && len(p.queue) == 0) {
+			p.cond.Wait()
+			i = p.ready()
+		}
+		if i < 0 {
+			p.mu.Unlock()
+			return
+		}
+		j := p.queue[i]
+		if i == 0 {
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+		} else {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+		}
+		if len(j.Key) > 0 {
+			p.active[j.Key] = true
+		}
+		p.mu.Unlock()
+		p.cond.Broadcast()
+
+		j.Run()
+
+		p.mu.Lock()
+		p.inflight -= int64(j.Size)
+		if len(j.Key) > 0 {
+			delete(p.active, j.Key)
+		}
+		p.mu.Unlock()
+		p.cond.Broadcast()
+	}
+}
+
+// ready return index of the first job whose key is not being processed, must be called with lock held
+func (p *Pool) ready() int {
+	for i, j := range p.queue {
+		if len(j.Key) == 0 || !p.active[j.Key] {
+			return i
+		}
+	}
+	return -1
+}
+
+func drop(j *Job) {
+	if j.Drop != nil {
+		j.Drop()
+	}
+}
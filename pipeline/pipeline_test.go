@@ -0,0 +1,317 @@
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// gate job blocking its worker until released
+type gate struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newGate() *gate {
+	return &gate{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (g *gate) job(size int) *Job {
+	return &Job{Size: size, Run: func() {
+		close(g.started)
+		<-g.release
+	}}
+}
+
+// recorder records jobs run or dropped by name
+type recorder struct {
+	mu      sync.Mutex
+	run     []string
+	dropped []string
+}
+
+func (r *recorder) job(name string, size int) *Job {
+	return &Job{
+		Size: size,
+		Run: func() {
+			r.mu.Lock()
+			r.run = append(r.run, name)
+			r.mu.Unlock()
+		},
+		Drop: func() {
+			r.mu.Lock()
+			r.dropped = append(r.dropped, name)
+			r.mu.Unlock()
+		},
+	}
+}
+
+func (r *recorder) result() (run, dropped []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.run...), append([]string(nil), r.dropped...)
+}
+
+func equal(t *testing.T, what string, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s = %q, want %q", what, got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("%s = %q, want %q", what, got, want)
+		}
+	}
+}
+
+// busyPool return pool whose only worker is blocked by gate
+func busyPool(t *testing.T, o *Options) (*Pool, *gate) {
+	t.Helper()
+	o.Workers = 1
+	p := New(o)
+	g := newGate()
+	p.Submit(g.job(0))
+	<-g.started
+	return p, g
+}
+
+func TestDropNewestPolicy(t *testing.T) {
+	p, g := busyPool(t, &Options{QueueSize: 1, QueuePolicy: DropNewestPolicy})
+	r := &recorder{}
+
+	if !p.Submit(r.job("a", 0)) {
+		t.Fatal("the first job must be queued")
+	}
+	if p.Submit(r.job("b", 0)) {
+		t.Fatal("job submitted to full queue must be dropped")
+	}
+	close(g.release)
+	p.Close(0)
+
+	run, dropped := r.result()
+	equal(t, "run", run, "a")
+	equal(t, "dropped", dropped, "b")
+}
+
+func TestDropOldestPolicy(t *testing.T) {
+	p, g := busyPool(t, &Options{QueueSize: 1, QueuePolicy: DropOldestPolicy})
+	r := &recorder{}
+
+	p.Submit(r.job("a", 0))
+	if !p.Submit(r.job("b", 0)) {
+		t.Fatal("the newest job must be queued")
+	}
+	close(g.release)
+	p.Close(0)
+
+	run, dropped := r.result()
+	equal(t, "run", run, "b")
+	equal(t, "dropped", dropped, "a")
+}
+
+func TestBlockPolicy(t *testing.T) {
+	p, g := busyPool(t, &Options{QueueSize: 1, QueuePolicy: BlockPolicy})
+	r := &recorder{}
+
+	p.Submit(r.job("a", 0))
+	submitted := make(chan bool)
+	go func() { submitted <- p.Submit(r.job("b", 0)) }()
+
+	select {
+	case <-submitted:
+		t.Fatal("submit to full queue must block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(g.release)
+	if !<-submitted {
+		t.Fatal("blocked job must be queued once queue has room")
+	}
+	p.Close(0)
+
+	run, dropped := r.result()
+	equal(t, "run", run, "a", "b")
+	equal(t, "dropped", dropped)
+}
+
+func TestMaxInflightBytes(t *testing.T) {
+	o := &Options{Workers: 1, MaxInflightBytes: 10, QueuePolicy: DropNewestPolicy}
+	p := New(o)
+	g := newGate()
+	p.Submit(g.job(6))
+	<-g.started
+	r := &recorder{}
+
+	if p.Submit(r.job("large", 5)) {
+		t.Fatal("job exceeding memory limit must be dropped")
+	}
+	if !p.Submit(r.job("small", 4)) {
+		t.Fatal("job within memory limit must be queued")
+	}
+	if n := p.InflightBytes(); n != 10 {
+		t.Fatalf("InflightBytes = %d, want 10", n)
+	}
+	close(g.release)
+	p.Close(0)
+
+	run, dropped := r.result()
+	equal(t, "run", run, "small")
+	equal(t, "dropped", dropped, "large")
+	if n := p.InflightBytes(); n != 0 {
+		t.Fatalf("InflightBytes after close = %d, want 0", n)
+	}
+}
+
+func TestSingleJobLargerThanLimit(t *testing.T) {
+	p := New(&Options{Workers: 1, MaxInflightBytes: 10, QueuePolicy: DropNewestPolicy})
+	r := &recorder{}
+
+	if !p.Submit(r.job("huge", 100)) {
+		t.Fatal("job larger than limit must be accepted when nothing is in flight")
+	}
+	p.Close(0)
+
+	run, _ := r.result()
+	equal(t, "run", run, "huge")
+}
+
+func TestCloseDropsQueuedJobsAfterTimeout(t *testing.T) {
+	p, g := busyPool(t, &Options{})
+	r := &recorder{}
+
+	p.Submit(r.job("a", 0))
+	p.Submit(r.job("b", 0))
+	// Close waits for the running job, so it's released once queued jobs are dropped
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(g.release)
+	}()
+	if n := p.Close(20 * time.Millisecond); n != 2 {
+		t.Fatalf("Close dropped %d jobs, want 2", n)
+	}
+
+	run, dropped := r.result()
+	equal(t, "run", run)
+	equal(t, "dropped", dropped, "a", "b")
+}
+
+func TestSubmitAfterClose(t *testing.T) {
+	p := New(&Options{Workers: 1})
+	p.Close(0)
+	r := &recorder{}
+
+	if p.Submit(r.job("a", 0)) {
+		t.Fatal("job submitted to closed pool must be dropped")
+	}
+	run, dropped := r.result()
+	equal(t, "run", run)
+	equal(t, "dropped", dropped, "a")
+}
+
+func TestSameKeyRunsSequentiallyInOrder(t *testing.T) {
+	p := New(&Options{Workers: 4})
+
+	var (
+		mu      sync.Mutex
+		active  int
+		overlap bool
+		order   []int
+	)
+	for i := 0; i < 50; i++ {
+		i := i
+		p.Submit(&Job{Key: "meter-1", Run: func() {
+			mu.Lock()
+			active++
+			overlap = overlap || active > 1
+			order = append(order, i)
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}})
+	}
+	p.Close(0)
+
+	if overlap {
+		t.Fatal("jobs with the same key ran concurrently")
+	}
+	for i, n := range order {
+		if n != i {
+			t.Fatalf("job %d ran at position %d", n, i)
+		}
+	}
+}
+
+func TestDifferentKeysRunConcurrently(t *testing.T) {
+	p := New(&Options{Workers: 2})
+	g := newGate()
+	r := &recorder{}
+
+	blocked := g.job(0)
+	blocked.Key = "a"
+	p.Submit(blocked)
+	<-g.started
+
+	// Job of the same key waits, job of another key overtakes it
+	same := r.job("a", 0)
+	same.Key = "a"
+	p.Submit(same)
+	other := r.job("b", 0)
+	other.Key = "b"
+	done := make(chan struct{})
+	run := other.Run
+	other.Run = func() {
+		run()
+		close(done)
+	}
+	p.Submit(other)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("job of another key is blocked by busy key")
+	}
+	close(g.release)
+	p.Close(0)
+
+	got, _ := r.result()
+	equal(t, "run", got, "b", "a")
+}
+
+func TestOrderKey(t *testing.T) {
+	payload := []byte(`{"meter":{"id":42},"kind":"heat"}`)
+	tests := []struct {
+		o    Options
+		want string
+	}{
+		{Options{OrderBy: NoOrder}, ""},
+		{Options{OrderBy: TopicOrder}, "device/m1/heat"},
+		{Options{OrderBy: SegmentOrder, OrderSegment: 1}, "device"},
+		{Options{OrderBy: SegmentOrder, OrderSegment: 2}, "m1"},
+		{Options{OrderBy: SegmentOrder, OrderSegment: -1}, "heat"},
+		{Options{OrderBy: SegmentOrder, OrderSegment: 4}, ""},
+		{Options{OrderBy: SegmentOrder, OrderSegment: -4}, ""},
+		{Options{OrderBy: FieldOrder, OrderField: "meter.id"}, "42"},
+		{Options{OrderBy: FieldOrder, OrderField: "kind"}, "heat"},
+		{Options{OrderBy: FieldOrder, OrderField: "meter.missing"}, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.o.OrderKey("device/m1/heat", payload); got != tt.want {
+			t.Errorf("OrderKey(%s, %d, %q) = %q, want %q", tt.o.OrderBy, tt.o.OrderSegment, tt.o.OrderField, got, tt.want)
+		}
+	}
+	if got := (&Options{OrderBy: FieldOrder, OrderField: "id"}).OrderKey("t", []byte("not json")); got != "" {
+		t.Errorf("OrderKey of invalid JSON = %q, want empty", got)
+	}
+}
+
+func TestValidateOrderSegment(t *testing.T) {
+	if err := (&Options{OrderBy: SegmentOrder}).Validate(); err == nil {
+		t.Error("segment ordering without segment number must be rejected")
+	}
+	if err := (&Options{OrderBy: SegmentOrder, OrderSegment: -1}).Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
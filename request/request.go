@@ -0,0 +1,212 @@
+package request
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gkhit/gscltmsd/db"
+)
+
+type (
+	// Options options of MQTT request/response queries
+	Options struct {
+		Enable bool `json:"enable,omitempty"`
+		// Topic filter of request topics, messages matching it are not handled by routes even if their filters match
+		Topic string `json:"topic"`
+		// ResponsePrefix leading topic levels response topics of requests must start with,
+		// responses to other topics are not published
+		ResponsePrefix string `json:"response_prefix"`
+		// Qos of subscription and responses
+		Qos byte `json:"qos,omitempty"`
+		// Timeout default timeout of request in seconds, including wait for free slot
+		Timeout int64 `json:"timeout"`
+		// MaxConcurrent default max number of concurrent calls of a procedure
+		MaxConcurrent int `json:"max_concurrent"`
+		// Procedures whitelist of procedures which can be called by requests
+		Procedures []Procedure `json:"procedures"`
+	}
+
+	// Procedure query procedure which can be called by requests
+	Procedure struct {
+		// Name of procedure in requests
+		Name string `json:"name"`
+		// EntryPoint SQL server procedure called
+		EntryPoint string `json:"entry_point"`
+		// Args names of arguments passed as named parameters, other arguments are rejected
+		Args []string `json:"args,omitempty"`
+		// Timeout of request in seconds, default one is used if 0
+		Timeout int64 `json:"timeout,omitempty"`
+		// MaxConcurrent max number of concurrent calls, default one is used if 0
+		MaxConcurrent int `json:"max_concurrent,omitempty"`
+	}
+
+	// Request query request received from MQTT
+	Request struct {
+		Procedure     string                     `json:"procedure"`
+		Args          map[string]json.RawMessage `json:"args,omitempty"`
+		ResponseTopic string                     `json:"response_topic"`
+		CorrelationID json.RawMessage            `json:"correlation_id,omitempty"`
+	}
+
+	// Response result of query published to response topic of request
+	Response struct {
+		CorrelationID json.RawMessage `json:"correlation_id,omitempty"`
+		OK            bool            `json:"ok"`
+		Error         string          `json:"error,omitempty"`
+		*db.Result
+	}
+
+	// Server whitelisted procedures with their concurrency limits
+	Server struct {
+		o     *Options
+		procs map[string]*proc
+	}
+
+	proc struct {
+		*Procedure
+		timeout time.Duration
+		slots   chan struct{}
+	}
+)
+
+// ErrBusy returned when no slot of procedure was free within request timeout
+var ErrBusy = errors.New("procedure is busy, try later")
+
+// New return new server of whitelisted procedures
+func New(o *Options) (*Server, error) {
+	if len(o.ResponsePrefix) <= 0 || strings.ContainsAny(o.ResponsePrefix, "+#\x00") || strings.HasPrefix(o.ResponsePrefix, "$") {
+		return nil, fmt.Errorf("requests response_prefix \"%s\" must be set and have no wildcards or leading '$'", o.ResponsePrefix)
+	}
+
+	s := &Server{o: o, procs: make(map[string]*proc, len(o.Procedures))}
+	for i := range o.Procedures {
+		p := &o.Procedures[i]
+		if len(p.Name) <= 0 || len(p.EntryPoint) <= 0 {
+			return nil, fmt.Errorf("request procedure %d must have name and entry point", i+1)
+		}
+		if _, ok := s.procs[p.Name]; ok {
+			return nil, fmt.Errorf("request procedure \"%s\" is duplicated", p.Name)
+		}
+
+		timeout := p.Timeout
+		if timeout <= 0 {
+			timeout = o.Timeout
+		}
+		n := p.MaxConcurrent
+		if n <= 0 {
+			n = o.MaxConcurrent
+		}
+		if n <= 0 {
+			n = 1
+		}
+		s.procs[p.Name] = &proc{
+			Procedure: p,
+			timeout:   time.Duration(timeout) * time.Second,
+			slots:     make(chan struct{}, n),
+		}
+	}
+	return s, nil
+}
+
+// Parse decode request, error means there is nowhere to respond to.
+// Response topic must be below response prefix and have no wildcards.
+func (s *Server) Parse(payload []byte) (*Request, error) {
+	req := &Request{}
+	if err := json.Unmarshal(payload, req); err != nil {
+		return nil, fmt.Errorf("can't decode request. %v", err)
+	}
+	if len(req.ResponseTopic) <= 0 || strings.ContainsAny(req.ResponseTopic, "+#\x00") {
+		return nil, errors.New("request must have response topic without wildcards")
+	}
+	prefix := strings.TrimSuffix(s.o.ResponsePrefix, "/") + "/"
+	if !strings.HasPrefix(req.ResponseTopic, prefix) || len(req.ResponseTopic) == len(prefix) {
+		return nil, fmt.Errorf("response topic \"%s\" is not below \"%s\"", req.ResponseTopic, s.o.ResponsePrefix)
+	}
+	return req, nil
+}
+
+// Call call whitelisted procedure of request with its arguments within timeout of procedure.
+// Call waits for a free slot if max number of concurrent calls is reached.
+func (s *Server) Call(ctx context.Context, req *Request, call func(ctx context.Context, query string, args []interface{}) (*db.Result, error)) (*db.Result, error) {
+	p, ok := s.procs[req.Procedure]
+	if !ok {
+		return nil, fmt.Errorf("procedure \"%s\" is not allowed", req.Procedure)
+	}
+	args, err := p.args(req.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ErrBusy
+	}
+	defer func() { <-p.slots }()
+
+	return call(ctx, p.EntryPoint, args)
+}
+
+// args return named parameters of request arguments, arguments not in whitelist are rejected.
+// Parameters missing in request are not passed, so defaults of procedure apply.
+func (p *proc) args(values map[string]json.RawMessage) ([]interface{}, error) {
+	for name := range values {
+		if !p.allowed(name) {
+			return nil, fmt.Errorf("argument \"%s\" is not allowed", name)
+		}
+	}
+
+	var args []interface{}
+	for _, name := range p.Args {
+		raw, ok := values[name]
+		if !ok {
+			continue
+		}
+		v, err := argValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("argument \"%s\". %v", name, err)
+		}
+		args = append(args, sql.Named(name, v))
+	}
+	return args, nil
+}
+
+func (p *proc) allowed(name string) bool {
+	for _, a := range p.Args {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// argValue convert JSON value of argument to SQL parameter value,
+// objects and arrays are passed as JSON text
+func argValue(raw json.RawMessage) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		return t.Float64()
+	case map[string]interface{}, []interface{}:
+		return string(raw), nil
+	}
+	return v, nil
+}
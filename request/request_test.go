@@ -0,0 +1,45 @@
+package request
+
+import "testing"
+
+func TestNewResponsePrefix(t *testing.T) {
+	for _, prefix := range []string{"", "$SYS/response", "response/+", "response/#"} {
+		if _, err := New(&Options{ResponsePrefix: prefix}); err == nil {
+			t.Errorf("response prefix %q accepted", prefix)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	s, err := New(&Options{ResponsePrefix: "gscltmsd/response/"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		payload string
+		ok      bool
+	}{
+		{"below prefix", `{"procedure":"p","response_topic":"gscltmsd/response/client1"}`, true},
+		{"deeper level", `{"procedure":"p","response_topic":"gscltmsd/response/client1/42"}`, true},
+		{"invalid json", `{"procedure":`, false},
+		{"no response topic", `{"procedure":"p"}`, false},
+		{"prefix itself", `{"procedure":"p","response_topic":"gscltmsd/response/"}`, false},
+		{"prefix without level", `{"procedure":"p","response_topic":"gscltmsd/response"}`, false},
+		{"prefix of level", `{"procedure":"p","response_topic":"gscltmsd/responses/client1"}`, false},
+		{"other topic", `{"procedure":"p","response_topic":"device/1/cmd"}`, false},
+		{"system topic", `{"procedure":"p","response_topic":"$SYS/broker/clients"}`, false},
+		{"single level wildcard", `{"procedure":"p","response_topic":"gscltmsd/response/+"}`, false},
+		{"multi level wildcard", `{"procedure":"p","response_topic":"gscltmsd/response/#"}`, false},
+	}
+	for _, tt := range tests {
+		req, err := s.Parse([]byte(tt.payload))
+		if tt.ok && (err != nil || req == nil) {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: response topic %q accepted", tt.name, req.ResponseTopic)
+		}
+	}
+}
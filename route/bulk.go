@@ -0,0 +1,39 @@
+package route
+
+// Bulk loading of messages into staging table with bulk copy protocol
+type Bulk struct {
+	// Table staging table, optionally with schema
+	Table string `json:"table"`
+	// TopicColumn column of topic, "topic" if empty
+	TopicColumn string `json:"topic_column,omitempty"`
+	// ReceivedColumn column of receive time, "received_at" if empty
+	ReceivedColumn string `json:"received_column,omitempty"`
+	// PayloadColumn column of payload converted to format of route, "payload" if empty
+	PayloadColumn string `json:"payload_column,omitempty"`
+	// FlushRows max number of rows in one load
+	FlushRows int `json:"flush_rows,omitempty"`
+	// FlushBytes max total size of payloads in one load, unlimited if not positive
+	FlushBytes int `json:"flush_bytes,omitempty"`
+	// FlushInterval max time in milliseconds rows wait for a load
+	FlushInterval int64 `json:"flush_interval,omitempty"`
+	// PostLoad procedure called in the same transaction after each load
+	PostLoad string `json:"post_load,omitempty"`
+	// Tablock take table lock for the time of load
+	Tablock bool `json:"tablock,omitempty"`
+}
+
+// Columns return columns of topic, receive time and payload
+func (b *Bulk) Columns() []string {
+	return []string{
+		orDefault(b.TopicColumn, "topic"),
+		orDefault(b.ReceivedColumn, "received_at"),
+		orDefault(b.PayloadColumn, "payload"),
+	}
+}
+
+func orDefault(s, def string) string {
+	if len(s) > 0 {
+		return s
+	}
+	return def
+}
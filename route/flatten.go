@@ -0,0 +1,134 @@
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/gkhit/gscltmsd/sm2x"
+)
+
+type (
+	// Flatten flattening of JSON payload into rows of table-valued parameter, one row per leaf.
+	// Table type of rows is expected to be
+	//
+	//	CREATE TYPE dbo.gscltmsd_leaf AS TABLE (
+	//	    path  nvarchar(450) NOT NULL,
+	//	    value nvarchar(max) NULL,
+	//	    type  varchar(10)   NOT NULL  -- string, number, bool or null
+	//	)
+	Flatten struct {
+		// TypeName table type of rows, optionally with schema
+		TypeName string `json:"type_name"`
+		// Separator of path levels, "." if empty
+		Separator string `json:"separator,omitempty"`
+		// Include path patterns of leaves to pass, all leaves if empty.
+		// '*' matches one level or part of it, '**' matches any number of levels.
+		Include []string `json:"include,omitempty"`
+		// Exclude path patterns of leaves to skip
+		Exclude []string `json:"exclude,omitempty"`
+	}
+
+	// Leaf row of table-valued parameter
+	Leaf struct {
+		Path  string
+		Value *string
+		Type  string
+	}
+)
+
+// ErrNotObject payload is not JSON object
+var ErrNotObject = errors.New("payload is not JSON object")
+
+// TVP return table-valued parameter with leaves of JSON payload
+func (f *Flatten) TVP(payload []byte) (mssql.TVP, error) {
+	doc, err := decodeJSON(payload)
+	if err != nil {
+		return mssql.TVP{}, err
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return mssql.TVP{}, ErrNotObject
+	}
+
+	sep := f.separator()
+	rows := make([]Leaf, 0)
+	for _, l := range sm2x.Flatten(m, sep) {
+		if !f.pass(l.Path, sep) {
+			continue
+		}
+		row := Leaf{Path: l.Path}
+		switch v := l.Value.(type) {
+		case nil:
+			row.Type = "null"
+		case string:
+			row.Type = "string"
+			row.Value = &v
+		case bool:
+			row.Type = "bool"
+			s := fmt.Sprint(v)
+			row.Value = &s
+		case json.Number:
+			row.Type = "number"
+			s := v.String()
+			row.Value = &s
+		default:
+			row.Type = "string"
+			s := fmt.Sprint(v)
+			row.Value = &s
+		}
+		rows = append(rows, row)
+	}
+	return mssql.TVP{TypeName: f.TypeName, Value: rows}, nil
+}
+
+func (f *Flatten) separator() string {
+	if len(f.Separator) > 0 {
+		return f.Separator
+	}
+	return "."
+}
+
+// pass check whether leaf is included and not excluded
+func (f *Flatten) pass(p, sep string) bool {
+	levels := strings.Split(p, sep)
+	for _, pt := range f.Exclude {
+		if matchLevels(strings.Split(pt, sep), levels) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pt := range f.Include {
+		if matchLevels(strings.Split(pt, sep), levels) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchLevels match path levels with pattern levels, '**' matches any number of levels
+func matchLevels(pattern, levels []string) bool {
+	if len(pattern) == 0 {
+		return len(levels) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(levels); i++ {
+			if matchLevels(pattern[1:], levels[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(levels) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], levels[0]); !ok {
+		return false
+	}
+	return matchLevels(pattern[1:], levels[1:])
+}
@@ -0,0 +1,129 @@
+package route
+
+import (
+	"strings"
+	"testing"
+)
+
+// leaves return rows of table-valued parameter as "path=value:type", value is "<nil>" if NULL
+func leaves(t *testing.T, f *Flatten, payload string) []string {
+	t.Helper()
+	tvp, err := f.TVP([]byte(payload))
+	if err != nil {
+		t.Fatalf("TVP(%s): %v", payload, err)
+	}
+	if tvp.TypeName != f.TypeName {
+		t.Errorf("type name %q, want %q", tvp.TypeName, f.TypeName)
+	}
+	var got []string
+	for _, l := range tvp.Value.([]Leaf) {
+		v := "<nil>"
+		if l.Value != nil {
+			v = *l.Value
+		}
+		got = append(got, l.Path+"="+v+":"+l.Type)
+	}
+	return got
+}
+
+func TestFlatten(t *testing.T) {
+	const payload = `{
+		"meter": "m1",
+		"-unit": "kWh",
+		"values": [1.5, 12345678901234567890, {"t": true}],
+		"state": {"ok": false, "note": null, "empty": "", "#text": "x"},
+		"none": [],
+		"deep": {"a": {"b": {"c": [[0]]}}}
+	}`
+	tests := []struct {
+		name string
+		f    Flatten
+		want []string
+	}{
+		{"all leaves", Flatten{TypeName: "dbo.leaf"}, []string{
+			"unit=kWh:string",
+			"deep.a.b.c.0.0=0:number",
+			"meter=m1:string",
+			"state=x:string",
+			"state.empty=:string",
+			"state.note=<nil>:null",
+			"state.ok=false:bool",
+			"values.0=1.5:number",
+			"values.1=12345678901234567890:number",
+			"values.2.t=true:bool",
+		}},
+		{"separator", Flatten{TypeName: "dbo.leaf", Separator: "/", Include: []string{"values/*", "deep/**"}}, []string{
+			"deep/a/b/c/0/0=0:number",
+			"values/0=1.5:number",
+			"values/1=12345678901234567890:number",
+		}},
+		{"include", Flatten{TypeName: "dbo.leaf", Include: []string{"state.*", "meter"}}, []string{
+			"meter=m1:string",
+			"state.empty=:string",
+			"state.note=<nil>:null",
+			"state.ok=false:bool",
+		}},
+		{"exclude over include", Flatten{TypeName: "dbo.leaf", Include: []string{"**"}, Exclude: []string{"**.t", "deep.**", "state.n*", "meter", "unit", "state"}}, []string{
+			"state.empty=:string",
+			"state.ok=false:bool",
+			"values.0=1.5:number",
+			"values.1=12345678901234567890:number",
+		}},
+	}
+	for _, tt := range tests {
+		got := leaves(t, &tt.f, payload)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: leaves\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestFlattenNotObject(t *testing.T) {
+	f := &Flatten{TypeName: "dbo.leaf"}
+	for _, p := range []string{`[1,2]`, `"text"`, `12`} {
+		if _, err := f.TVP([]byte(p)); err != ErrNotObject {
+			t.Errorf("TVP(%s) error = %v, want %v", p, err, ErrNotObject)
+		}
+	}
+	if _, err := f.TVP([]byte(`{"a":`)); err == nil {
+		t.Error("invalid JSON accepted")
+	}
+	if got := leaves(t, f, `{"-":1,"a":{}}`); len(got) != 1 || got[0] != "=1:number" {
+		t.Errorf("leaves of empty attribute key = %q", got)
+	}
+}
+
+func TestMatchLevels(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.b", "a.b.c", false},
+		{"a.b.c", "a.b", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.b*", "a.bc", true},
+		{"*.c", "a.c", true},
+		{"a.**", "a", true},
+		{"a.**", "a.b.c", true},
+		{"**.c", "c", true},
+		{"**.c", "a.b.c", true},
+		{"**.c", "a.c.d", false},
+		{"a.**.d", "a.d", true},
+		{"a.**.d", "a.b.c.d", true},
+		{"a.**.d", "a.b.c", false},
+		{"**", "a.b", true},
+		{"a.[0-1]", "a.1", true},
+		{"a.[0-1]", "a.2", false},
+	}
+	for _, tt := range tests {
+		if got := matchLevels(strings.Split(tt.pattern, "."), strings.Split(tt.path, ".")); got != tt.want {
+			t.Errorf("matchLevels(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+	if !matchLevels(nil, nil) || matchLevels(nil, []string{"a"}) {
+		t.Error("empty pattern must match empty path only")
+	}
+}
@@ -0,0 +1,188 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+type (
+	// Format format of payload passed to SQL server entry point
+	Format int
+
+	// KeyCase normalization of JSON object keys
+	KeyCase int
+)
+
+const (
+	// DefaultFormat JSON if to_xml is false, XML otherwise
+	DefaultFormat Format = iota
+	// XMLFormat JSON payload converted to XML
+	XMLFormat
+	// JSONFormat JSON payload validated and optionally normalized
+	JSONFormat
+	// RawFormat payload bytes passed unchanged as varbinary
+	RawFormat
+)
+
+const (
+	// KeepCase keys are not changed
+	KeepCase KeyCase = iota
+	// LowerCase keys are converted to lower case
+	LowerCase
+	// UpperCase keys are converted to upper case
+	UpperCase
+)
+
+var (
+	toStringFormat = map[Format]string{
+		DefaultFormat: "default",
+		XMLFormat:     "xml",
+		JSONFormat:    "json",
+		RawFormat:     "raw",
+	}
+
+	toIDFormat = map[string]Format{
+		"default": DefaultFormat,
+		"xml":     XMLFormat,
+		"json":    JSONFormat,
+		"raw":     RawFormat,
+	}
+
+	toStringKeyCase = map[KeyCase]string{
+		KeepCase:  "keep",
+		LowerCase: "lower",
+		UpperCase: "upper",
+	}
+
+	toIDKeyCase = map[string]KeyCase{
+		"keep":  KeepCase,
+		"lower": LowerCase,
+		"upper": UpperCase,
+	}
+)
+
+// ErrInvalidJSON payload is not valid JSON
+var ErrInvalidJSON = errors.New("payload is not valid JSON")
+
+func (s Format) String() string {
+	return toStringFormat[s]
+}
+
+// MarshalJSON marshals the enum as a quoted json string
+func (s Format) MarshalJSON() ([]byte, error) {
+	buffer := bytes.NewBufferString(`"`)
+	buffer.WriteString(toStringFormat[s])
+	buffer.WriteString(`"`)
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON unmashals a quoted json string to the enum value
+func (s *Format) UnmarshalJSON(b []byte) error {
+	var j string
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	// Note that if the string cannot be found then it will be set to the zero value, 'default' in this case.
+	*s = toIDFormat[j]
+	return nil
+}
+
+func (s KeyCase) String() string {
+	return toStringKeyCase[s]
+}
+
+// MarshalJSON marshals the enum as a quoted json string
+func (s KeyCase) MarshalJSON() ([]byte, error) {
+	buffer := bytes.NewBufferString(`"`)
+	buffer.WriteString(toStringKeyCase[s])
+	buffer.WriteString(`"`)
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON unmashals a quoted json string to the enum value
+func (s *KeyCase) UnmarshalJSON(b []byte) error {
+	var j string
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	// Note that if the string cannot be found then it will be set to the zero value, 'keep' in this case.
+	*s = toIDKeyCase[j]
+	return nil
+}
+
+// Encoding return format of payload passed to entry point
+func (o *Options) Encoding() Format {
+	if o.Format != DefaultFormat {
+		return o.Format
+	}
+	if o.ToXML != nil && !*o.ToXML {
+		return JSONFormat
+	}
+	return XMLFormat
+}
+
+// EncodeJSON return JSON payload to pass to entry point. Payload is sent unchanged unless
+// canonical form, minification or key normalization is requested.
+func (o *Options) EncodeJSON(payload []byte) ([]byte, error) {
+	if !json.Valid(payload) {
+		return nil, ErrInvalidJSON
+	}
+	if !o.JSONCanonical && o.JSONKeyCase == KeepCase {
+		if !o.JSONMinify {
+			return payload, nil
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, payload); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	// Numbers are kept as they are, float64 would lose precision of big integers
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	v = normalizeKeys(v, o.JSONKeyCase)
+
+	// Encoder sorts keys of maps, so equal documents give equal bytes
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if !o.JSONMinify {
+		e.SetIndent("", "  ")
+	}
+	if err := e.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// normalizeKeys change case of object keys recursively
+func normalizeKeys(v interface{}, c KeyCase) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			switch c {
+			case LowerCase:
+				k = strings.ToLower(k)
+			case UpperCase:
+				k = strings.ToUpper(k)
+			}
+			m[k] = normalizeKeys(e, c)
+		}
+		return m
+	case []interface{}:
+		for i, e := range t {
+			t[i] = normalizeKeys(e, c)
+		}
+	}
+	return v
+}
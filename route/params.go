@@ -0,0 +1,547 @@
+package route
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/golang-sql/civil"
+)
+
+type (
+	// Source source of entry point parameter value
+	Source int
+
+	// SQLType SQL server type of entry point parameter
+	SQLType int
+
+	// Param named parameter of entry point
+	Param struct {
+		// Name of parameter without '@'
+		Name string `json:"name"`
+		// Source of value, payload if empty
+		Source Source `json:"source,omitempty"`
+		// Segment number of topic level for segment source starting from 1, negative numbers count from the end
+		Segment int `json:"segment,omitempty"`
+		// Path dot separated path of JSON field for json source
+		Path string `json:"path,omitempty"`
+		// Type of parameter, default type of source if empty
+		Type SQLType `json:"type,omitempty"`
+		// Output output parameter, its value is read after call and source is ignored
+		Output bool `json:"output,omitempty"`
+	}
+
+	// Message data of message available to parameters
+	Message struct {
+		Topic     string
+		Payload   []byte
+		Received  time.Time
+		Qos       byte
+		Retained  bool
+		Duplicate bool
+		MessageID uint16
+	}
+)
+
+const (
+	// PayloadSource payload converted to format of route
+	PayloadSource Source = iota
+	// TopicSource topic of message
+	TopicSource
+	// ReceivedSource time message was received at
+	ReceivedSource
+	// QosSource QoS of message
+	QosSource
+	// RetainedSource retained flag of message
+	RetainedSource
+	// DuplicateSource duplicate flag of message
+	DuplicateSource
+	// MessageIDSource MQTT packet identifier of message
+	MessageIDSource
+	// DeviceSource topic level of route device_id_segment, or "device_id" level of topic template
+	DeviceSource
+	// SegmentSource topic level of parameter segment
+	SegmentSource
+	// JSONSource field of JSON payload
+	JSONSource
+)
+
+const (
+	// DefaultType type depends on source
+	DefaultType SQLType = iota
+	// NVarCharType nvarchar(max)
+	NVarCharType
+	// XMLType xml, passed as nvarchar(max) and converted by SQL server
+	XMLType
+	// VarBinaryType varbinary(max)
+	VarBinaryType
+	// DateTime2Type datetime2
+	DateTime2Type
+	// BigIntType bigint
+	BigIntType
+	// BitType bit
+	BitType
+)
+
+var (
+	toStringSource = map[Source]string{
+		PayloadSource:   "payload",
+		TopicSource:     "topic",
+		ReceivedSource:  "received_at",
+		QosSource:       "qos",
+		RetainedSource:  "retained",
+		DuplicateSource: "duplicate",
+		MessageIDSource: "message_id",
+		DeviceSource:    "device_id",
+		SegmentSource:   "segment",
+		JSONSource:      "json",
+	}
+
+	toIDSource = map[string]Source{
+		"payload":     PayloadSource,
+		"topic":       TopicSource,
+		"received_at": ReceivedSource,
+		"qos":         QosSource,
+		"retained":    RetainedSource,
+		"duplicate":   DuplicateSource,
+		"message_id":  MessageIDSource,
+		"device_id":   DeviceSource,
+		"segment":     SegmentSource,
+		"json":        JSONSource,
+	}
+
+	toStringSQLType = map[SQLType]string{
+		DefaultType:   "default",
+		NVarCharType:  "nvarchar(max)",
+		XMLType:       "xml",
+		VarBinaryType: "varbinary(max)",
+		DateTime2Type: "datetime2",
+		BigIntType:    "bigint",
+		BitType:       "bit",
+	}
+
+	toIDSQLType = map[string]SQLType{
+		"default":        DefaultType,
+		"nvarchar":       NVarCharType,
+		"nvarchar(max)":  NVarCharType,
+		"xml":            XMLType,
+		"varbinary":      VarBinaryType,
+		"varbinary(max)": VarBinaryType,
+		"datetime2":      DateTime2Type,
+		"bigint":         BigIntType,
+		"bit":            BitType,
+	}
+)
+
+func (s Source) String() string {
+	return toStringSource[s]
+}
+
+// MarshalJSON marshals the enum as a quoted json string
+func (s Source) MarshalJSON() ([]byte, error) {
+	buffer := bytes.NewBufferString(`"`)
+	buffer.WriteString(toStringSource[s])
+	buffer.WriteString(`"`)
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON unmashals a quoted json string to the enum value
+func (s *Source) UnmarshalJSON(b []byte) error {
+	var j string
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	id, ok := toIDSource[j]
+	if !ok {
+		return fmt.Errorf("unknown parameter source \"%s\"", j)
+	}
+	*s = id
+	return nil
+}
+
+func (s SQLType) String() string {
+	return toStringSQLType[s]
+}
+
+// MarshalJSON marshals the enum as a quoted json string
+func (s SQLType) MarshalJSON() ([]byte, error) {
+	buffer := bytes.NewBufferString(`"`)
+	buffer.WriteString(toStringSQLType[s])
+	buffer.WriteString(`"`)
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON unmashals a quoted json string to the enum value
+func (s *SQLType) UnmarshalJSON(b []byte) error {
+	var j string
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	id, ok := toIDSQLType[strings.ToLower(strings.ReplaceAll(j, " ", ""))]
+	if !ok {
+		return fmt.Errorf("unsupported parameter type \"%s\"", j)
+	}
+	*s = id
+	return nil
+}
+
+// Statement return T-SQL template of route, or its entry point procedure
+func (o *Options) Statement() string {
+	if len(o.Query) > 0 {
+		return o.Query
+	}
+	return o.EntryPointFunc
+}
+
+// Validate check parameters of route
+func (o *Options) Validate() error {
+	if o.Reply != nil && len(o.Reply.Topic) <= 0 {
+		return fmt.Errorf("route \"%s\" has reply without topic", o.ID())
+	}
+	if o.Reply != nil && overlap(o.Topic, o.Reply.filter(o.Topic)) {
+		// Reply would be handled by the route again and replied to in a loop
+		return fmt.Errorf("route \"%s\" reply topic \"%s\" is matched by its topic filter", o.ID(), o.Reply.Topic)
+	}
+	if o.Bulk != nil {
+		if len(o.Bulk.Table) <= 0 {
+			return fmt.Errorf("route \"%s\" has bulk load without table", o.ID())
+		}
+		return nil
+	}
+	if o.Flatten != nil && len(o.Flatten.TypeName) <= 0 {
+		return fmt.Errorf("route \"%s\" has flattening without table type", o.ID())
+	}
+	if o.Table != nil {
+		if len(o.Table.Name) <= 0 || len(o.Table.Columns) == 0 {
+			return fmt.Errorf("route \"%s\" has table without name or columns", o.ID())
+		}
+		if o.Table.Unmapped == OverflowUnmapped && len(o.Table.OverflowColumn) <= 0 {
+			return fmt.Errorf("route \"%s\" has no overflow column", o.ID())
+		}
+		return o.validateParams(o.Table.Columns)
+	}
+	if len(o.Query) <= 0 && len(o.EntryPointFunc) <= 0 {
+		return fmt.Errorf("route \"%s\" has neither entry point nor query", o.ID())
+	}
+	return o.validateParams(o.Params)
+}
+
+func (o *Options) validateParams(params []Param) error {
+	for _, p := range params {
+		switch {
+		case len(p.Name) <= 0:
+			return fmt.Errorf("route \"%s\" has parameter without name", o.ID())
+		case p.Source == SegmentSource && p.Segment == 0:
+			return fmt.Errorf("route \"%s\" parameter \"%s\" has no topic segment", o.ID(), p.Name)
+		case p.Source == DeviceSource && o.DeviceIDSegment == 0 && !strings.Contains(o.Template, "{device_id}"):
+			return fmt.Errorf("route \"%s\" parameter \"%s\" needs device_id_segment", o.ID(), p.Name)
+		case p.Source == JSONSource && len(p.Path) <= 0:
+			return fmt.Errorf("route \"%s\" parameter \"%s\" has no JSON path", o.ID(), p.Name)
+		}
+	}
+	return nil
+}
+
+// Args return arguments of entry point call for message and its payload converted to format of route.
+// Without parameters topic and payload are passed positionally to procedure, or as @topic and @payload to query.
+// Named levels of topic template follow them if requested.
+func (o *Options) Args(m *Message, payload []byte) ([]interface{}, error) {
+	var args []interface{}
+
+	params := o.Params
+	if len(params) == 0 {
+		if len(o.Query) <= 0 {
+			v, err := o.payloadArg(m, payload)
+			if err != nil {
+				return nil, err
+			}
+			args = []interface{}{m.Topic, v}
+		} else {
+			params = []Param{{Name: "topic", Source: TopicSource}, {Name: "payload", Source: PayloadSource}}
+		}
+	}
+
+	values, err := o.Values(params, m, payload)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		args = append(args, sql.Named(params[i].Name, v))
+	}
+
+	if o.SegmentParams {
+		for _, sg := range o.Segments(m.Topic) {
+			args = append(args, sql.Named(sg.Name, sg.Value))
+		}
+	}
+	return args, nil
+}
+
+// Values return values of parameters for message and its payload converted to format of route,
+// values are converted to Go types the driver sends as parameter types
+func (o *Options) Values(params []Param, m *Message, payload []byte) ([]interface{}, error) {
+	var (
+		doc    interface{}
+		values = make([]interface{}, 0, len(params))
+		segs   = o.Segments(m.Topic)
+	)
+
+	for i := range params {
+		p := &params[i]
+		if p.Output {
+			values = append(values, sql.Out{Dest: outputDest(p.Type)})
+			continue
+		}
+
+		var v interface{}
+		switch p.Source {
+		case PayloadSource:
+			var err error
+			if v, err = o.payloadArg(m, payload); err != nil {
+				return nil, fmt.Errorf("parameter \"%s\". %v", p.Name, err)
+			}
+			// Table-valued parameter is passed as is
+			if tvp, ok := v.(mssql.TVP); ok {
+				values = append(values, tvp)
+				continue
+			}
+		case TopicSource:
+			v = m.Topic
+		case ReceivedSource:
+			v = m.Received
+		case QosSource:
+			v = int64(m.Qos)
+		case RetainedSource:
+			v = m.Retained
+		case DuplicateSource:
+			v = m.Duplicate
+		case MessageIDSource:
+			v = int64(m.MessageID)
+		case DeviceSource:
+			if o.DeviceIDSegment != 0 {
+				v = segment(m.Topic, o.DeviceIDSegment)
+			} else {
+				v = segmentValue(segs, "device_id")
+			}
+		case SegmentSource:
+			v = segment(m.Topic, p.Segment)
+		case JSONSource:
+			if doc == nil {
+				var err error
+				if doc, err = decodeJSON(m.Payload); err != nil {
+					return nil, fmt.Errorf("parameter \"%s\". %v", p.Name, err)
+				}
+			}
+			v = lookup(doc, p.Path)
+		}
+
+		v, err := convertValue(v, p.Type)
+		if err != nil {
+			return nil, fmt.Errorf("parameter \"%s\". %v", p.Name, err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// payloadArg return argument of payload, leaves of JSON payload if flattening is configured
+func (o *Options) payloadArg(m *Message, payload []byte) (interface{}, error) {
+	if o.Flatten != nil {
+		return o.Flatten.TVP(m.Payload)
+	}
+	return o.PayloadValue(payload), nil
+}
+
+// PayloadValue return payload as binary for raw format and as text otherwise
+func (o *Options) PayloadValue(payload []byte) interface{} {
+	if o.Encoding() == RawFormat {
+		return payload
+	}
+	return string(payload)
+}
+
+// segment return topic level by number starting from 1, negative numbers count from the end.
+// Nil is returned if topic has no such level.
+func segment(topic string, n int) interface{} {
+	levels := strings.Split(topic, "/")
+	if n < 0 {
+		n = len(levels) + n + 1
+	}
+	if n < 1 || n > len(levels) {
+		return nil
+	}
+	return levels[n-1]
+}
+
+// lookup return field of JSON document by dot separated path, nil if it's missing
+func lookup(doc interface{}, path string) interface{} {
+	v := doc
+	for _, k := range strings.Split(path, ".") {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			v = t[k]
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil
+			}
+			v = t[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// convertValue convert value to Go type the driver sends as SQL type, nil values become typed NULLs
+func convertValue(v interface{}, t SQLType) (interface{}, error) {
+	if t == DefaultType {
+		switch v.(type) {
+		case time.Time:
+			t = DateTime2Type
+		case int64:
+			t = BigIntType
+		case bool:
+			t = BitType
+		case []byte:
+			t = VarBinaryType
+		default:
+			t = NVarCharType
+		}
+	}
+
+	switch t {
+	case DateTime2Type:
+		if v == nil {
+			return nil, nil
+		}
+		tm, err := toTime(v)
+		if err != nil {
+			return nil, err
+		}
+		return civil.DateTimeOf(tm), nil
+	case BigIntType:
+		if v == nil {
+			return sql.NullInt64{}, nil
+		}
+		n, err := toInt(v)
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	case BitType:
+		if v == nil {
+			return sql.NullBool{}, nil
+		}
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			return strconv.ParseBool(b)
+		}
+		n, err := toInt(v)
+		if err != nil {
+			return nil, err
+		}
+		return n != 0, nil
+	case VarBinaryType:
+		switch b := v.(type) {
+		case nil:
+			return []byte(nil), nil
+		case []byte:
+			return b, nil
+		}
+		return []byte(toText(v)), nil
+	}
+	// nvarchar and xml
+	if v == nil {
+		return sql.NullString{}, nil
+	}
+	return toText(v), nil
+}
+
+// toText return string value as is and other values as JSON
+func toText(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func toInt(v interface{}) (int64, error) {
+	switch t := v.(type) {
+	case int64:
+		return t, nil
+	case bool:
+		if t {
+			return 1, nil
+		}
+		return 0, nil
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n, nil
+		}
+		f, err := t.Float64()
+		return int64(f), err
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(t), 10, 64)
+	}
+	return 0, fmt.Errorf("can't convert %v to bigint", v)
+}
+
+// toTime accept RFC 3339 strings and Unix time in seconds
+func toTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		return time.Parse(time.RFC3339Nano, t)
+	case json.Number:
+		f, err := t.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		sec := int64(f)
+		return time.Unix(sec, int64((f-float64(sec))*1e9)), nil
+	}
+	return time.Time{}, fmt.Errorf("can't convert %v to datetime2", v)
+}
+
+// outputDest return destination of output parameter of type
+func outputDest(t SQLType) interface{} {
+	switch t {
+	case VarBinaryType:
+		return new([]byte)
+	case DateTime2Type:
+		return new(sql.NullTime)
+	case BigIntType:
+		return new(sql.NullInt64)
+	case BitType:
+		return new(sql.NullBool)
+	}
+	return new(sql.NullString)
+}
+
+// decodeJSON decode JSON document keeping numbers as they are
+func decodeJSON(data []byte) (interface{}, error) {
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,71 @@
+package route
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Reply publishing of entry point results to MQTT
+type Reply struct {
+	// Topic of reply derived from topic of message. '{topic}' is replaced with the whole topic,
+	// '{N}' with level N starting from 1 (negative numbers count from the end) and '{name}' with named level
+	// of topic template, e.g. "device/{2}/ack" for "device/x/data".
+	// Topic filter of route must not match reply topic, otherwise replies are handled by the route in a loop.
+	Topic  string `json:"topic"`
+	Qos    byte   `json:"qos,omitempty"`
+	Retain bool   `json:"retain,omitempty"`
+	// Empty publish reply even if result set, output parameters and return status are empty
+	Empty bool `json:"empty,omitempty"`
+}
+
+// filter return topic filter matching all replies to messages of route topic filter.
+// Levels with placeholders match any level, the whole topic placeholder is replaced with route filter.
+func (r *Reply) filter(topic string) string {
+	var levels []string
+	for _, l := range strings.Split(r.Topic, "/") {
+		switch {
+		case l == "{topic}":
+			levels = append(levels, strings.Split(topic, "/")...)
+		case strings.Contains(l, "{topic}"):
+			return strings.Join(append(levels, "#"), "/")
+		case strings.Contains(l, "{"):
+			levels = append(levels, "+")
+		default:
+			levels = append(levels, l)
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+// ReplyTopic return topic of reply to message of topic
+func (o *Options) ReplyTopic(topic string) string {
+	segs := o.Segments(topic)
+
+	var sb strings.Builder
+	t := o.Reply.Topic
+	for {
+		i := strings.Index(t, "{")
+		j := strings.Index(t, "}")
+		if i < 0 || j < i {
+			sb.WriteString(t)
+			return sb.String()
+		}
+		sb.WriteString(t[:i])
+		name := t[i+1 : j]
+		t = t[j+1:]
+
+		if name == "topic" {
+			sb.WriteString(topic)
+			continue
+		}
+		if n, err := strconv.Atoi(name); err == nil {
+			if v, ok := segment(topic, n).(string); ok {
+				sb.WriteString(v)
+			}
+			continue
+		}
+		if v, ok := segmentValue(segs, name).(string); ok {
+			sb.WriteString(v)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package route
+
+import "testing"
+
+func TestReplyTopic(t *testing.T) {
+	tests := []struct {
+		template string
+		reply    string
+		topic    string
+		want     string
+	}{
+		{"", "ack/{topic}", "device/s1/data", "ack/device/s1/data"},
+		{"", "device/{2}/ack", "device/s1/data", "device/s1/ack"},
+		{"", "ack/{-1}/{-2}", "device/s1/data", "ack/data/s1"},
+		{"", "ack/{4}/{-4}", "device/s1/data", "ack//"},
+		{"device/{site}/{meter}", "ack/{site}/{meter}", "device/s1/m2", "ack/s1/m2"},
+		{"device/{site}/{meter}", "ack/{site}-{1}", "device/s1/m2", "ack/s1-device"},
+		{"device/{site}/{meter}", "ack/{kind}", "device/s1/m2", "ack/"},
+		{"", "ack/fixed", "device/s1/data", "ack/fixed"},
+		{"", "ack/}{2}", "device/s1/data", "ack/}{2}"},
+	}
+	for _, tt := range tests {
+		o := &Options{Template: tt.template, Reply: &Reply{Topic: tt.reply}}
+		if got := o.ReplyTopic(tt.topic); got != tt.want {
+			t.Errorf("ReplyTopic of %q by %q = %q, want %q", tt.topic, tt.reply, got, tt.want)
+		}
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"device/+/data", "device/s1/data", true},
+		{"device/+/data", "device/s1/ack", false},
+		{"device/#", "device", true},
+		{"device/#", "ack/device", false},
+		{"+/+", "a/#", true},
+		{"a/b", "a/b/c", false},
+		{"#", "x/y/z", true},
+	}
+	for _, tt := range tests {
+		if got := overlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("overlap(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := overlap(tt.b, tt.a); got != tt.want {
+			t.Errorf("overlap(%q, %q) = %v, want %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestValidateReplyLoop(t *testing.T) {
+	tests := []struct {
+		topic string
+		reply string
+		ok    bool
+	}{
+		{"device/+/data", "device/{2}/ack", true},
+		{"device/+/data", "{topic}/ack", true},
+		{"device/+/data", "ack/{topic}", true},
+		{"device/#", "ack/{2}", true},
+		{"device/+/data", "device/{2}/data", false},
+		{"device/+/+", "device/{2}/ack", false},
+		{"device/#", "device/{2}/ack", false},
+		{"device/#", "{topic}/ack", false},
+		{"#", "ack/{topic}", false},
+		{"ack/#", "ack{topic}", false},
+	}
+	for _, tt := range tests {
+		o := &Options{Topic: tt.topic, EntryPointFunc: "dbo.p", Reply: &Reply{Topic: tt.reply}}
+		err := o.Validate()
+		if tt.ok && err != nil {
+			t.Errorf("route %q with reply %q rejected. %v", tt.topic, tt.reply, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("route %q with reply %q accepted", tt.topic, tt.reply)
+		}
+	}
+
+	if err := (&Options{Topic: "device/#", EntryPointFunc: "dbo.p", Reply: &Reply{}}).Validate(); err == nil {
+		t.Error("reply without topic accepted")
+	}
+}
@@ -0,0 +1,120 @@
+package route
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+type (
+	// Options route of messages from topic filter to SQL server entry point
+	Options struct {
+		// Name of route, topic filter is used if empty
+		Name           string `json:"name,omitempty"`
+		Topic          string `json:"topic"`
+		Qos            byte   `json:"qos,omitempty"`
+		EntryPointFunc string `json:"entry_point"`
+		XMLRoot        string `json:"xml_root,omitempty"`
+		// XMLExtArray convert arrays to extended form, taken from database section if not set
+		XMLExtArray *bool `json:"xml_ext_array,omitempty"`
+		// ToXML convert JSON payload to XML, taken from database section if not set
+		ToXML *bool `json:"to_xml,omitempty"`
+		// Format of payload passed to entry point, chosen by ToXML if default
+		Format Format `json:"format,omitempty"`
+		// JSONCanonical re-serialize JSON payload with sorted keys
+		JSONCanonical bool `json:"json_canonical,omitempty"`
+		// JSONMinify remove insignificant whitespace from JSON payload
+		JSONMinify bool `json:"json_minify,omitempty"`
+		// JSONKeyCase change case of JSON object keys
+		JSONKeyCase KeyCase `json:"json_key_case,omitempty"`
+		// Query parameterized T-SQL statement called instead of entry point procedure
+		Query string `json:"query,omitempty"`
+		// Params named parameters of entry point or query, topic and payload are passed if empty
+		Params []Param `json:"params,omitempty"`
+		// Template topic template with named levels, e.g. "device/{site}/{meter}/{kind}".
+		// Topic filter is derived from template if empty.
+		Template string `json:"template,omitempty"`
+		// SegmentAttributes add named levels of topic as attributes of XML root element
+		SegmentAttributes bool `json:"segment_attributes,omitempty"`
+		// SegmentParams pass named levels of topic as extra nvarchar parameters
+		SegmentParams bool `json:"segment_params,omitempty"`
+		// SegmentFields add named levels of topic to JSON payload as fields before conversion
+		SegmentFields bool `json:"segment_fields,omitempty"`
+		// Table rows are inserted into table instead of calling entry point
+		Table *Table `json:"table,omitempty"`
+		// Bulk messages are bulk loaded into staging table instead of calling entry point
+		Bulk *Bulk `json:"bulk,omitempty"`
+		// Flatten leaves of JSON payload are passed as table-valued parameter instead of converted payload
+		Flatten *Flatten `json:"flatten,omitempty"`
+		// Reply results of entry point are published to MQTT
+		Reply *Reply `json:"reply,omitempty"`
+		// DeviceIDSegment number of topic level holding device id, starting from 1, negative numbers count from the end
+		DeviceIDSegment int `json:"device_id_segment,omitempty"`
+		// Schema JSON schema payload is validated against before conversion, violations are rejected
+		Schema json.RawMessage `json:"schema,omitempty"`
+		// SchemaFile file of JSON schema, used if schema is empty
+		SchemaFile string `json:"schema_file,omitempty"`
+	}
+)
+
+// ID return name of route, or its topic filter if name is empty
+func (o *Options) ID() string {
+	if len(o.Name) > 0 {
+		return o.Name
+	}
+	return o.Topic
+}
+
+// Match check whether topic matches MQTT topic filter with '+' and '#' wildcards
+func Match(filter, topic string) bool {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+
+	for i, f := range fs {
+		if f == "#" {
+			// '#' doesn't match topics starting with '$' on the first level
+			return i > 0 || !strings.HasPrefix(topic, "$")
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f == "+" {
+			if i == 0 && strings.HasPrefix(ts[0], "$") {
+				return false
+			}
+			continue
+		}
+		if f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// overlap check whether some topic is matched by both topic filters
+func overlap(a, b string) bool {
+	as := strings.Split(a, "/")
+	bs := strings.Split(b, "/")
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == "#" || bs[i] == "#" {
+			return true
+		}
+		if as[i] != "+" && bs[i] != "+" && as[i] != bs[i] {
+			return false
+		}
+	}
+	// '#' matches parent level too
+	return len(as) == len(bs) ||
+		len(as) == len(bs)+1 && as[len(bs)] == "#" ||
+		len(bs) == len(as)+1 && bs[len(as)] == "#"
+}
+
+// Find return the first route matching topic
+func Find(routes []*Options, topic string) *Options {
+	for _, r := range routes {
+		if Match(r.Topic, topic) {
+			return r
+		}
+	}
+	return nil
+}
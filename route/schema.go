@@ -0,0 +1,29 @@
+package route
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/gkhit/gscltmsd/schema"
+)
+
+// LoadSchema return compiled JSON schema of route, nil if route has none.
+// Inline schema takes precedence over schema file.
+func (o *Options) LoadSchema() (*schema.Schema, error) {
+	data := []byte(o.Schema)
+	if len(data) == 0 && len(o.SchemaFile) > 0 {
+		var err error
+		if data, err = ioutil.ReadFile(o.SchemaFile); err != nil {
+			return nil, fmt.Errorf("route \"%s\": can't read schema file. %v", o.ID(), err)
+		}
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	s, err := schema.Compile(data)
+	if err != nil {
+		return nil, fmt.Errorf("route \"%s\": %v", o.ID(), err)
+	}
+	return s, nil
+}
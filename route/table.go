@@ -0,0 +1,104 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+type (
+	// Unmapped handling of payload fields not mapped to columns
+	Unmapped int
+
+	// Table insertion of messages as rows of table
+	Table struct {
+		// Name of table, optionally with schema
+		Name string `json:"name"`
+		// Columns filled like parameters of entry point, name of parameter is name of column.
+		// Type of column is read from table if not set.
+		Columns []Param `json:"columns"`
+		// Unmapped handling of top level payload fields not mapped to columns by json source.
+		// No field is unmapped if payload is stored whole in column of payload source.
+		Unmapped Unmapped `json:"unmapped,omitempty"`
+		// OverflowColumn column collecting unmapped fields
+		OverflowColumn string `json:"overflow_column,omitempty"`
+		// OverflowFormat format of overflow column, json or xml
+		OverflowFormat Format `json:"overflow_format,omitempty"`
+	}
+)
+
+const (
+	// ErrorUnmapped message with unmapped fields is rejected
+	ErrorUnmapped Unmapped = iota
+	// IgnoreUnmapped unmapped fields are ignored
+	IgnoreUnmapped
+	// OverflowUnmapped unmapped fields are collected into overflow column
+	OverflowUnmapped
+)
+
+var (
+	toStringUnmapped = map[Unmapped]string{
+		ErrorUnmapped:    "error",
+		IgnoreUnmapped:   "ignore",
+		OverflowUnmapped: "overflow",
+	}
+
+	toIDUnmapped = map[string]Unmapped{
+		"error":    ErrorUnmapped,
+		"ignore":   IgnoreUnmapped,
+		"overflow": OverflowUnmapped,
+	}
+)
+
+func (s Unmapped) String() string {
+	return toStringUnmapped[s]
+}
+
+// MarshalJSON marshals the enum as a quoted json string
+func (s Unmapped) MarshalJSON() ([]byte, error) {
+	buffer := bytes.NewBufferString(`"`)
+	buffer.WriteString(toStringUnmapped[s])
+	buffer.WriteString(`"`)
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON unmashals a quoted json string to the enum value
+func (s *Unmapped) UnmarshalJSON(b []byte) error {
+	var j string
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	// Note that if the string cannot be found then it will be set to the zero value, 'error' in this case.
+	*s = toIDUnmapped[j]
+	return nil
+}
+
+// UnmappedFields return top level fields of JSON object payload not mapped to columns,
+// nil if there are none, payload is not an object or it's stored whole in payload column
+func (t *Table) UnmappedFields(payload []byte) map[string]interface{} {
+	for _, c := range t.Columns {
+		if c.Source == PayloadSource && !c.Output {
+			return nil
+		}
+	}
+
+	doc, err := decodeJSON(payload)
+	if err != nil {
+		return nil
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, c := range t.Columns {
+		if c.Source == JSONSource {
+			delete(m, strings.SplitN(c.Path, ".", 2)[0])
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,96 @@
+package route
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Segment named topic level captured by topic template
+type Segment struct {
+	Name  string
+	Value string
+}
+
+// TemplateFilter return topic filter of topic template, '{name}' levels are replaced with '+'
+func TemplateFilter(template string) string {
+	levels := strings.Split(template, "/")
+	for i, l := range levels {
+		if isVariable(l) {
+			levels[i] = "+"
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+// Segments return named levels of topic by topic template of route, nil if there is no template
+// or topic doesn't match it
+func (o *Options) Segments(topic string) []Segment {
+	if len(o.Template) <= 0 {
+		return nil
+	}
+
+	tl := strings.Split(o.Template, "/")
+	ts := strings.Split(topic, "/")
+	var segs []Segment
+	for i, l := range tl {
+		if l == "#" {
+			return segs
+		}
+		if i >= len(ts) {
+			return nil
+		}
+		switch {
+		case isVariable(l):
+			segs = append(segs, Segment{Name: l[1 : len(l)-1], Value: ts[i]})
+		case l != "+" && l != ts[i]:
+			return nil
+		}
+	}
+	if len(tl) != len(ts) {
+		return nil
+	}
+	return segs
+}
+
+// AddFields add segments to JSON object payload as fields, fields of payload are not overwritten
+func AddFields(payload []byte, segs []Segment) ([]byte, error) {
+	if len(segs) == 0 {
+		return payload, nil
+	}
+
+	var m map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&m); err != nil {
+		return nil, fmt.Errorf("topic segments can be added to JSON object only. %v", err)
+	}
+	for _, sg := range segs {
+		if _, ok := m[sg.Name]; !ok {
+			m[sg.Name] = sg.Value
+		}
+	}
+
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(m); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// segmentValue return value of named segment, nil if it's missing
+func segmentValue(segs []Segment, name string) interface{} {
+	for _, sg := range segs {
+		if sg.Name == name {
+			return sg.Value
+		}
+	}
+	return nil
+}
+
+func isVariable(level string) bool {
+	return len(level) > 2 && strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}")
+}
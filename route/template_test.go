@@ -0,0 +1,92 @@
+package route
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestTemplateFilter(t *testing.T) {
+	tests := []struct{ template, want string }{
+		{"device/{site}/{meter}/{kind}", "device/+/+/+"},
+		{"device/{site}/+/data", "device/+/+/data"},
+		{"device/{site}/#", "device/+/#"},
+		{"device/{}/x", "device/{}/x"},
+		{"meter", "meter"},
+	}
+	for _, tt := range tests {
+		if got := TemplateFilter(tt.template); got != tt.want {
+			t.Errorf("TemplateFilter(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	tests := []struct {
+		template string
+		topic    string
+		want     []Segment
+	}{
+		{"device/{site}/{meter}/{kind}", "device/s1/m2/data", []Segment{{"site", "s1"}, {"meter", "m2"}, {"kind", "data"}}},
+		// '+' level matches any level without capturing it
+		{"device/+/{meter}/data", "device/s1/m2/data", []Segment{{"meter", "m2"}}},
+		// '#' matches the rest of topic, levels before it are captured
+		{"device/{site}/#", "device/s1/m2/data", []Segment{{"site", "s1"}}},
+		{"device/{site}/#", "device/s1", []Segment{{"site", "s1"}}},
+		{"device/{site}/{meter}", "device/s1/", []Segment{{"site", "s1"}, {"meter", ""}}},
+		{"device/+/data", "device/s1/data", nil},
+		{"device/{site}/{meter}/data", "device/s1/m2/info", nil},
+		{"device/{site}/{meter}", "device/s1", nil},
+		{"device/{site}", "device/s1/m2", nil},
+		{"", "device/s1", nil},
+	}
+	for _, tt := range tests {
+		o := &Options{Template: tt.template}
+		if got := o.Segments(tt.topic); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Segments of %q by %q = %v, want %v", tt.topic, tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestSegmentValues(t *testing.T) {
+	o := &Options{Template: "device/{site}/{device_id}/#"}
+	params := []Param{
+		{Name: "first", Source: SegmentSource, Segment: 1},
+		{Name: "last", Source: SegmentSource, Segment: -1},
+		{Name: "second_last", Source: SegmentSource, Segment: -2},
+		{Name: "beyond", Source: SegmentSource, Segment: 5},
+		{Name: "before", Source: SegmentSource, Segment: -5},
+		{Name: "device", Source: DeviceSource},
+	}
+	m := &Message{Topic: "device/s1/m2/data"}
+
+	got, err := o.Values(params, m, nil)
+	if err != nil {
+		t.Fatalf("Values: %v", err)
+	}
+	want := []interface{}{"device", "data", "m2", sql.NullString{}, sql.NullString{}, "m2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Values = %#v, want %#v", got, want)
+	}
+
+	// Level of device_id_segment takes precedence over named level
+	o.DeviceIDSegment = -1
+	if got, _ = o.Values(params[5:], m, nil); !reflect.DeepEqual(got, []interface{}{"data"}) {
+		t.Errorf("device by segment -1 = %#v, want \"data\"", got)
+	}
+}
+
+func TestAddFields(t *testing.T) {
+	segs := []Segment{{"site", "s1"}, {"meter", "m2"}}
+	got, err := AddFields([]byte(`{"meter":"own","v":12345678901234567890}`), segs)
+	if err != nil {
+		t.Fatalf("AddFields: %v", err)
+	}
+	if want := `{"meter":"own","site":"s1","v":12345678901234567890}`; string(got) != want {
+		t.Errorf("AddFields = %s, want %s", got, want)
+	}
+
+	if _, err = AddFields([]byte(`[1,2]`), segs); err == nil {
+		t.Error("segments added to array")
+	}
+}
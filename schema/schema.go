@@ -0,0 +1,342 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type (
+	// Schema JSON Schema draft 7 subset: type, enum, required, properties, additionalProperties, items,
+	// numeric ranges, string lengths and patterns, array lengths. Other keywords are ignored.
+	Schema struct {
+		Type                 Types              `json:"type,omitempty"`
+		Enum                 []interface{}      `json:"enum,omitempty"`
+		Required             []string           `json:"required,omitempty"`
+		Properties           map[string]*Schema `json:"properties,omitempty"`
+		AdditionalProperties json.RawMessage    `json:"additionalProperties,omitempty"`
+		Items                *Schema            `json:"items,omitempty"`
+		Minimum              *float64           `json:"minimum,omitempty"`
+		Maximum              *float64           `json:"maximum,omitempty"`
+		ExclusiveMinimum     *float64           `json:"exclusiveMinimum,omitempty"`
+		ExclusiveMaximum     *float64           `json:"exclusiveMaximum,omitempty"`
+		MinLength            *int               `json:"minLength,omitempty"`
+		MaxLength            *int               `json:"maxLength,omitempty"`
+		Pattern              string             `json:"pattern,omitempty"`
+		MinItems             *int               `json:"minItems,omitempty"`
+		MaxItems             *int               `json:"maxItems,omitempty"`
+
+		pattern *regexp.Regexp
+		// additional schema of properties not listed in properties, nil if any is allowed
+		additional *Schema
+		// noAdditional properties not listed in properties are not allowed
+		noAdditional bool
+	}
+
+	// Types allowed JSON types, single type or array of them
+	Types []string
+
+	// Violation failed constraint of value at JSON path
+	Violation struct {
+		Path    string `json:"path"`
+		Message string `json:"message"`
+	}
+
+	// Error violations of schema found in document
+	Error struct {
+		Violations []Violation
+	}
+)
+
+var types = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true, "number": true, "integer": true, "string": true,
+}
+
+// Compile parse schema document and compile its patterns
+func Compile(data []byte) (*Schema, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	s := &Schema{}
+	if err := d.Decode(s); err != nil {
+		return nil, fmt.Errorf("can't decode JSON schema. %v", err)
+	}
+	if err := s.compile("$"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// UnmarshalJSON unmarshals type keyword given as string or array of strings
+func (t *Types) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = Types{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*t = many
+	return nil
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Path+": "+v.Message)
+	}
+	return "schema violation. " + strings.Join(msgs, "; ")
+}
+
+// Validate check value decoded by json.Unmarshal against schema, returns *Error listing all violations
+func (s *Schema) Validate(v interface{}) error {
+	var vs []Violation
+	s.validate("$", v, &vs)
+	if len(vs) > 0 {
+		return &Error{Violations: vs}
+	}
+	return nil
+}
+
+// compile check keywords of schema and compile patterns, path is used in errors
+func (s *Schema) compile(path string) error {
+	for _, t := range s.Type {
+		if !types[t] {
+			return fmt.Errorf("schema %s: unknown type \"%s\"", path, t)
+		}
+	}
+	if len(s.Pattern) > 0 {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("schema %s: invalid pattern. %v", path, err)
+		}
+		s.pattern = re
+	}
+
+	switch a := strings.TrimSpace(string(s.AdditionalProperties)); a {
+	case "", "true":
+	case "false":
+		s.noAdditional = true
+	default:
+		s.additional = &Schema{}
+		d := json.NewDecoder(strings.NewReader(a))
+		d.UseNumber()
+		if err := d.Decode(s.additional); err != nil {
+			return fmt.Errorf("schema %s: invalid additionalProperties. %v", path, err)
+		}
+		if err := s.additional.compile(path + ".*"); err != nil {
+			return err
+		}
+	}
+
+	for k, p := range s.Properties {
+		if p == nil {
+			return fmt.Errorf("schema %s: property \"%s\" must be schema", path, k)
+		}
+		if err := p.compile(childPath(path, k)); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(path + "[*]")
+	}
+	return nil
+}
+
+func (s *Schema) validate(path string, v interface{}, vs *[]Violation) {
+	add := func(format string, a ...interface{}) {
+		*vs = append(*vs, Violation{Path: path, Message: fmt.Sprintf(format, a...)})
+	}
+
+	if len(s.Type) > 0 && !s.Type.match(v) {
+		add("must be %s, got %s", strings.Join(s.Type, " or "), typeOf(v))
+		return
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if equal(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add("must be one of %s", enumString(s.Enum))
+		}
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		s.validateObject(path, t, vs)
+	case []interface{}:
+		if s.MinItems != nil && len(t) < *s.MinItems {
+			add("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(t) > *s.MaxItems {
+			add("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range t {
+				s.Items.validate(path+"["+strconv.Itoa(i)+"]", item, vs)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(t)
+		if s.MinLength != nil && n < *s.MinLength {
+			add("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			add("must be at most %d characters long", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(t) {
+			add("must match pattern %q", s.Pattern)
+		}
+	case float64, json.Number:
+		f, _ := number(t)
+		if s.Minimum != nil && f < *s.Minimum {
+			add("must be >= %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			add("must be <= %v", *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && f <= *s.ExclusiveMinimum {
+			add("must be > %v", *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && f >= *s.ExclusiveMaximum {
+			add("must be < %v", *s.ExclusiveMaximum)
+		}
+	}
+}
+
+func (s *Schema) validateObject(path string, m map[string]interface{}, vs *[]Violation) {
+	for _, k := range s.Required {
+		if _, ok := m[k]; !ok {
+			*vs = append(*vs, Violation{Path: childPath(path, k), Message: "is required"})
+		}
+	}
+
+	// Keys are sorted, so violations are reported in the same order every time
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if p, ok := s.Properties[k]; ok {
+			p.validate(childPath(path, k), m[k], vs)
+			continue
+		}
+		switch {
+		case s.noAdditional:
+			*vs = append(*vs, Violation{Path: childPath(path, k), Message: "is not allowed"})
+		case s.additional != nil:
+			s.additional.validate(childPath(path, k), m[k], vs)
+		}
+	}
+}
+
+// match check whether value is of one of types
+func (t Types) match(v interface{}) bool {
+	vt := typeOf(v)
+	for _, typ := range t {
+		switch {
+		case typ == vt:
+			return true
+		case typ == "number" && vt == "integer":
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf return JSON type of value, numbers without fractional part are integers
+func typeOf(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64, json.Number:
+		if f, ok := number(t); ok && f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func number(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return t, true
+	case json.Number:
+		f, err := t.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// equal compare JSON values, numbers are compared by value
+func equal(a, b interface{}) bool {
+	if fa, ok := number(a); ok {
+		fb, ok := number(b)
+		return ok && fa == fb
+	}
+	switch ta := a.(type) {
+	case map[string]interface{}:
+		tb, ok := b.(map[string]interface{})
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for k, va := range ta {
+			vb, ok := tb[k]
+			if !ok || !equal(va, vb) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		tb, ok := b.([]interface{})
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for i := range ta {
+			if !equal(ta[i], tb[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func enumString(values []interface{}) string {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Sprint(values)
+	}
+	return string(b)
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// childPath return JSON path of object key, keys which are not identifiers are quoted
+func childPath(path, key string) string {
+	if identifier.MatchString(key) {
+		return path + "." + key
+	}
+	return path + "[" + strconv.Quote(key) + "]"
+}
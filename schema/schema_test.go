@@ -0,0 +1,156 @@
+package schema
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const meterSchema = `{
+	"type": "object",
+	"required": ["meter", "value"],
+	"additionalProperties": false,
+	"properties": {
+		"meter": {"type": "string", "pattern": "^[0-9]+$", "minLength": 2, "maxLength": 8},
+		"value": {"type": "number", "minimum": 0, "exclusiveMaximum": 1000},
+		"count": {"type": "integer", "exclusiveMinimum": 0, "maximum": 10},
+		"kind": {"enum": ["heat", "water", 1]},
+		"tags": {"type": "array", "minItems": 1, "maxItems": 2, "items": {"type": ["string", "null"]}},
+		"extra": {"type": "object", "additionalProperties": {"type": "boolean"}},
+		"my key": {"type": "boolean"}
+	}
+}`
+
+func compile(t *testing.T, s string) *Schema {
+	t.Helper()
+	sc, err := Compile([]byte(s))
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	return sc
+}
+
+func validate(t *testing.T, sc *Schema, doc string) []Violation {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		t.Fatalf("invalid document %s: %v", doc, err)
+	}
+	err := sc.Validate(v)
+	if err == nil {
+		return nil
+	}
+	se, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Validate returned %T, want *Error", err)
+	}
+	return se.Violations
+}
+
+func TestValidDocument(t *testing.T) {
+	sc := compile(t, meterSchema)
+	docs := []string{
+		`{"meter":"123","value":12.5}`,
+		`{"meter":"12","value":0,"count":10,"kind":"heat","tags":["a",null],"extra":{"x":true},"my key":false}`,
+		`{"meter":"12","value":999.99,"kind":1.0}`,
+	}
+	for _, d := range docs {
+		if vs := validate(t, sc, d); vs != nil {
+			t.Errorf("%s: unexpected violations %v", d, vs)
+		}
+	}
+}
+
+func TestViolations(t *testing.T) {
+	sc := compile(t, meterSchema)
+	tests := []struct {
+		doc  string
+		path string
+		msg  string
+	}{
+		{`[]`, "$", "must be object, got array"},
+		{`{"value":1}`, "$.meter", "is required"},
+		{`{"meter":"12"}`, "$.value", "is required"},
+		{`{"meter":12,"value":1}`, "$.meter", "must be string, got integer"},
+		{`{"meter":"1","value":1}`, "$.meter", "at least 2 characters"},
+		{`{"meter":"123456789","value":1}`, "$.meter", "at most 8 characters"},
+		{`{"meter":"12a","value":1}`, "$.meter", "must match pattern"},
+		{`{"meter":"12","value":-1}`, "$.value", "must be >= 0"},
+		{`{"meter":"12","value":1000}`, "$.value", "must be < 1000"},
+		{`{"meter":"12","value":"1"}`, "$.value", "must be number, got string"},
+		{`{"meter":"12","value":1,"count":1.5}`, "$.count", "must be integer, got number"},
+		{`{"meter":"12","value":1,"count":0}`, "$.count", "must be > 0"},
+		{`{"meter":"12","value":1,"count":11}`, "$.count", "must be <= 10"},
+		{`{"meter":"12","value":1,"kind":"gas"}`, "$.kind", `must be one of ["heat","water",1]`},
+		{`{"meter":"12","value":1,"tags":[]}`, "$.tags", "at least 1 items"},
+		{`{"meter":"12","value":1,"tags":["a","b","c"]}`, "$.tags", "at most 2 items"},
+		{`{"meter":"12","value":1,"tags":["a",5]}`, "$.tags[1]", "must be string or null, got integer"},
+		{`{"meter":"12","value":1,"extra":{"x":1}}`, "$.extra.x", "must be boolean, got integer"},
+		{`{"meter":"12","value":1,"my key":1}`, `$["my key"]`, "must be boolean, got integer"},
+		{`{"meter":"12","value":1,"unknown":1}`, "$.unknown", "is not allowed"},
+	}
+	for _, tt := range tests {
+		vs := validate(t, sc, tt.doc)
+		if len(vs) != 1 {
+			t.Errorf("%s: got violations %v, want one at %s", tt.doc, vs, tt.path)
+			continue
+		}
+		if vs[0].Path != tt.path || !strings.Contains(vs[0].Message, tt.msg) {
+			t.Errorf("%s: got %s: %s, want %s: %s", tt.doc, vs[0].Path, vs[0].Message, tt.path, tt.msg)
+		}
+	}
+}
+
+func TestAllViolationsReported(t *testing.T) {
+	sc := compile(t, meterSchema)
+	vs := validate(t, sc, `{"meter":"x","value":-1,"z":1,"a":2}`)
+
+	var paths []string
+	for _, v := range vs {
+		paths = append(paths, v.Path)
+	}
+	// Required properties first, then properties in key order
+	want := "$.a $.meter $.meter $.value $.z"
+	if got := strings.Join(paths, " "); got != want {
+		t.Fatalf("paths %q, want %q", got, want)
+	}
+
+	err := sc.Validate(map[string]interface{}{"value": 1.0})
+	if err == nil || !strings.Contains(err.Error(), "$.meter: is required") {
+		t.Fatalf("Error() = %v, want violation path and message", err)
+	}
+}
+
+func TestNumbersDecodedWithUseNumber(t *testing.T) {
+	sc := compile(t, meterSchema)
+	v := map[string]interface{}{"meter": "12", "value": json.Number("2000"), "count": json.Number("2.5")}
+	err := sc.Validate(v)
+	se, ok := err.(*Error)
+	if !ok || len(se.Violations) != 2 {
+		t.Fatalf("Validate = %v, want 2 violations", err)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	bad := []string{
+		`not json`,
+		`{"type":"str"}`,
+		`{"type":["string",1]}`,
+		`{"pattern":"("}`,
+		`{"properties":{"a":{"pattern":"["}}}`,
+		`{"items":{"type":"nope"}}`,
+		`{"additionalProperties":{"type":"nope"}}`,
+	}
+	for _, s := range bad {
+		if _, err := Compile([]byte(s)); err == nil {
+			t.Errorf("Compile(%s) must fail", s)
+		}
+	}
+}
+
+func TestUnknownKeywordsIgnored(t *testing.T) {
+	sc := compile(t, `{"$schema":"http://json-schema.org/draft-07/schema#","title":"x","format":"date","type":"string"}`)
+	if vs := validate(t, sc, `"anything"`); vs != nil {
+		t.Fatalf("unexpected violations %v", vs)
+	}
+}
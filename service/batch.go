@@ -0,0 +1,65 @@
+package service
+
+import (
+	"bytes"
+	"encoding/xml"
+
+	"github.com/gkhit/gscltmsd/route"
+)
+
+// batchItem converted message waiting for batch call
+type batchItem struct {
+	msg     *message
+	payload []byte
+}
+
+// batchable check whether messages of route can be sent to batch entry point. Batch document is XML
+// with bare payloads, so only routes converting to XML and calling entry point of database section
+// without own parameters are batched, messages of other routes are sent one by one.
+func (s *Service) batchable(r *route.Options) bool {
+	return s.batcher != nil && r.Table == nil && r.Flatten == nil && r.Reply == nil &&
+		r.Encoding() == route.XMLFormat && len(r.Query) <= 0 && len(r.Params) == 0 && !r.SegmentParams &&
+		r.EntryPointFunc == s.opt.Database.EntryPointFunc
+}
+
+// processBatch send accumulated messages as one XML document to the batch entry point.
+// Messages are sent one by one if the batch call fails.
+//
+//	<batch>
+//	  <message topic="device/1/data"><doc>...</doc></message>
+//	  ...
+//	</batch>
+func (s *Service) processBatch(items []interface{}) {
+	var buf bytes.Buffer
+
+	root := s.opt.Database.BatchRoot
+	buf.WriteString("<" + root + ">")
+	for _, it := range items {
+		bi := it.(*batchItem)
+		buf.WriteString(`<message topic="`)
+		xml.EscapeText(&buf, []byte(bi.msg.Topic))
+		buf.WriteString(`">`)
+		buf.Write(bi.payload)
+		buf.WriteString("</message>")
+	}
+	buf.WriteString("</" + root + ">")
+
+	_, err := s.call(s.opt.Database.BatchEntryPointFunc, s.opt.Database.BatchEntryPointFunc, buf.String())
+	if err == nil {
+		for _, it := range items {
+			it.(*batchItem).msg.finish(true)
+		}
+		return
+	}
+
+	s.log.Printf("[WARN] Batch of %d messages failed, falling back to per-message calls.\n", len(items))
+	for _, it := range items {
+		bi := it.(*batchItem)
+		// Keep order of messages once one of them is spooled
+		if s.spool != nil && s.spool.Len() > 0 {
+			s.toSpool(bi.msg)
+			continue
+		}
+		s.send(bi.msg, bi.payload)
+	}
+}
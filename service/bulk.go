@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/gkhit/gscltmsd/db"
+	"github.com/gkhit/gscltmsd/pipeline"
+	"github.com/gkhit/gscltmsd/route"
+)
+
+// newBulkLoaders return batchers of routes bulk loading messages into staging tables
+func (s *Service) newBulkLoaders() map[*route.Options]*pipeline.Batcher {
+	loaders := make(map[*route.Options]*pipeline.Batcher)
+	for _, r := range s.routes {
+		if r.Bulk == nil {
+			continue
+		}
+		rows := r.Bulk.FlushRows
+		if rows <= 0 {
+			rows = 1000
+		}
+		interval := r.Bulk.FlushInterval
+		if interval <= 0 {
+			interval = 1000
+		}
+
+		r := r
+		b := pipeline.NewBatcher(rows, time.Duration(interval)*time.Millisecond, func(items []interface{}) {
+			s.processBulk(r, items)
+		})
+		b.SetMaxBytes(r.Bulk.FlushBytes)
+		loaders[r] = b
+	}
+	return loaders
+}
+
+// processBulk load accumulated messages into staging table of route.
+// Messages are spooled on transient error and dead-lettered on permanent one.
+func (s *Service) processBulk(r *route.Options, items []interface{}) {
+	rows := make([][]interface{}, 0, len(items))
+	for _, it := range items {
+		bi := it.(*batchItem)
+		rows = append(rows, bulkRow(r, bi.msg, bi.payload))
+	}
+
+	n, err := s.bulkLoad(r, rows)
+	if err == nil {
+		if s.opt.Debug {
+			s.log.Printf("[DEBUG] Bulk loaded %d messages into \"%s\".\n", len(items), r.Bulk.Table)
+		}
+		for _, it := range items {
+			it.(*batchItem).msg.finish(true)
+		}
+		return
+	}
+
+	for _, it := range items {
+		bi := it.(*batchItem)
+		if s.spool != nil && s.transient(err) {
+			s.toSpool(bi.msg)
+			continue
+		}
+		s.deadLetter(bi.msg, bi.payload, err, n)
+	}
+}
+
+// bulkLoad load rows into staging table of route, transient errors are retried.
+// Returns number of attempts made.
+func (s *Service) bulkLoad(r *route.Options, rows [][]interface{}) (int, error) {
+	n, err := db.Retry(s.ctx, &s.opt.Database, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(s.opt.Database.Timeout)*time.Second)
+		defer cancel()
+
+		start := time.Now()
+		err := db.BulkLoad(ctx, s.db, r.Bulk, rows)
+		s.metrics.observeCall(r.Bulk.Table, start, err)
+		return err
+	})
+	s.stats.add(err)
+	if err != nil {
+		s.log.Printf("[ERROR] Bulk load of %d messages into \"%s\" failed. %v\n", len(rows), r.Bulk.Table, err)
+	}
+	return n, err
+}
+
+// bulkRow return row of staging table for message
+func bulkRow(r *route.Options, msg *message, payload []byte) []interface{} {
+	return []interface{}{msg.Topic, msg.Received, r.PayloadValue(payload)}
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gkhit/gscltmsd/db"
+	"github.com/gkhit/gscltmsd/deadletter"
+	"github.com/gkhit/gscltmsd/metrics"
+)
+
+// deadLetter write message rejected by conversion or entry point to dead-letter destination
+func (s *Service) deadLetter(msg *message, payload []byte, cause error, attempts int) {
+	if s.dl == nil {
+		// Rejected message is handled, but one failed by transient error is not
+		msg.finish(!s.transient(cause))
+		return
+	}
+
+	e := &deadletter.Entry{
+		Topic:     msg.Topic,
+		Payload:   string(msg.Payload),
+		Converted: string(payload),
+		Error:     cause.Error(),
+		Attempts:  attempts,
+		Received:  msg.Received,
+		Failed:    time.Now(),
+	}
+	err := s.dl.Write(e)
+	if err != nil {
+		s.log.Printf("[ERROR] Can't write dead letter of topic \"%s\", message lost. %v\n", msg.Topic, err)
+	}
+	msg.finish(err == nil)
+}
+
+// publish publish payload to MQTT server and wait for completion
+func (s *Service) publish(topic string, qos byte, payload []byte) error {
+	token := s.clt.Publish(topic, qos, false, payload)
+	token.Wait()
+	return token.Error()
+}
+
+// Reinject send dead-lettered messages of all pipelines to SQL server entry points again
+func Reinject(o *Options) error {
+	if len(o.Pipelines) == 0 {
+		return reinject(o)
+	}
+	for _, po := range o.Pipelines {
+		if err := reinject(po); err != nil {
+			return fmt.Errorf("pipeline \"%s\". %v", po.Name, err)
+		}
+	}
+	return nil
+}
+
+// reinject send dead-lettered messages of pipeline to SQL server entry points again
+func reinject(o *Options) error {
+	s := &Service{
+		opt:   o,
+		log:   newLogger(o.Name),
+		ctx:   context.Background(),
+		stats: newCallStats(0),
+	}
+	o.Database.Logger = s.log
+
+	pool, err := db.New(&o.Database)
+	if err != nil {
+		return fmt.Errorf("can't connect to SQL server. %v", err)
+	}
+	defer pool.Close()
+
+	s.db = pool
+	s.metrics = s.newMetrics(metrics.NewRegistry())
+	s.routes = o.routeList()
+	if s.schemas, err = loadSchemas(s.routes); err != nil {
+		return err
+	}
+	if s.inserters, err = s.prepareTables(pool); err != nil {
+		return err
+	}
+
+	ok, failed, err := deadletter.Reinject(&o.DeadLetter, s.db, func(e *deadletter.Entry) error {
+		msg := &message{
+			Topic:    e.Topic,
+			Payload:  []byte(e.Payload),
+			Received: e.Received,
+		}
+		if err := s.validate(msg); err != nil {
+			return err
+		}
+		payload, err := s.convert(msg)
+		if err != nil {
+			return err
+		}
+		_, err = s.exec(msg, payload)
+		return err
+	})
+	s.log.Printf("[INFO] Reinjected %d dead letters, %d failed again.\n", ok, failed)
+	if err != nil {
+		return fmt.Errorf("reinject of dead letters stopped. %v", err)
+	}
+	return nil
+}
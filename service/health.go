@@ -0,0 +1,145 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	// callStats outcomes of SQL server calls within sliding window of one second buckets
+	callStats struct {
+		mu      sync.Mutex
+		buckets []callBucket
+		// lastOK time of the last successful call, nil until the first one
+		lastOK *time.Time
+	}
+
+	callBucket struct {
+		sec    int64
+		total  int
+		failed int
+	}
+
+	// healthReport body of health endpoints
+	healthReport struct {
+		State         string     `json:"state"`
+		MqttConnected bool       `json:"mqtt_connected"`
+		Subscribed    bool       `json:"subscribed"`
+		DatabaseReady bool       `json:"database_ready"`
+		LastSQLCall   *time.Time `json:"last_sql_call,omitempty"`
+		SQLCalls      int        `json:"sql_calls"`
+		SQLErrors     int        `json:"sql_errors"`
+		SQLErrorRate  float64    `json:"sql_error_rate"`
+		Ready         bool       `json:"ready"`
+	}
+)
+
+func newCallStats(window int64) *callStats {
+	if window <= 0 {
+		window = 60
+	}
+	return &callStats{buckets: make([]callBucket, window)}
+}
+
+// add record outcome of SQL server call
+func (c *callStats) add(err error) {
+	now := time.Now()
+	sec := now.Unix()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := &c.buckets[sec%int64(len(c.buckets))]
+	if b.sec != sec {
+		*b = callBucket{sec: sec}
+	}
+	b.total++
+	if err != nil {
+		b.failed++
+	} else {
+		c.lastOK = &now
+	}
+}
+
+// rate return number of calls and failed calls within window
+func (c *callStats) rate() (total int, failed int, lastOK *time.Time) {
+	from := time.Now().Unix() - int64(len(c.buckets))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, b := range c.buckets {
+		if b.sec > from {
+			total += b.total
+			failed += b.failed
+		}
+	}
+	return total, failed, c.lastOK
+}
+
+// health build health report
+func (s *Service) health() *healthReport {
+	st := s.Status()
+	r := &healthReport{
+		State:         st.State.String(),
+		MqttConnected: st.MqttConnected,
+		Subscribed:    st.Subscribed,
+		DatabaseReady: st.DatabaseReady,
+	}
+	r.SQLCalls, r.SQLErrors, r.LastSQLCall = s.stats.rate()
+	if r.SQLCalls > 0 {
+		r.SQLErrorRate = float64(r.SQLErrors) / float64(r.SQLCalls)
+	}
+
+	maxRate := s.opt.HTTP.MaxErrorRate
+	if maxRate <= 0 {
+		maxRate = 1
+	}
+	r.Ready = st.State == StateRunning && st.MqttConnected && st.Subscribed && st.DatabaseReady &&
+		r.SQLErrorRate <= maxRate
+	return r
+}
+
+// livezHandler process is alive
+func (p *Process) livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// healthzHandler report state, fails only when service is stopping
+func (p *Process) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	p.writeReports(w, func(rep *healthReport) bool { return rep.State != StateStopping.String() })
+}
+
+// readyzHandler report state, fails unless all pipelines are consuming and SQL servers are healthy
+func (p *Process) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	p.writeReports(w, func(rep *healthReport) bool { return rep.Ready })
+}
+
+// writeReports write report of the only pipeline, or reports of all pipelines by name
+func (p *Process) writeReports(w http.ResponseWriter, ok func(rep *healthReport) bool) {
+	if len(p.opt.Pipelines) == 0 {
+		rep := p.pipelines[0].health()
+		writeReport(w, rep, ok(rep))
+		return
+	}
+
+	reps := make(map[string]*healthReport, len(p.pipelines))
+	all := true
+	for _, s := range p.pipelines {
+		rep := s.health()
+		reps[s.opt.Name] = rep
+		all = all && ok(rep)
+	}
+	writeReport(w, reps, all)
+}
+
+func writeReport(w http.ResponseWriter, rep interface{}, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"database/sql"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gkhit/gscltmsd/db"
+	"github.com/gkhit/gscltmsd/metrics"
+	"github.com/gkhit/gscltmsd/route"
+)
+
+// serviceMetrics operational metrics of service
+type serviceMetrics struct {
+	received      *metrics.CounterVec
+	parseFailures *metrics.CounterVec
+	convFailures  *metrics.CounterVec
+	rejects       *metrics.CounterVec
+	sqlDuration   *metrics.HistogramVec
+	sqlErrors     *metrics.CounterVec
+	reconnects    *metrics.CounterVec
+	inflight      int64
+}
+
+// newMetrics register metrics of service
+func (s *Service) newMetrics(r *metrics.Registry) *serviceMetrics {
+	m := &serviceMetrics{
+		received: r.Counter("gscltmsd_messages_received_total",
+			"MQTT messages received by route.", "route"),
+		parseFailures: r.Counter("gscltmsd_json_parse_failures_total",
+			"Messages whose payload is not valid JSON."),
+		convFailures: r.Counter("gscltmsd_xml_conversion_failures_total",
+			"Messages that could not be converted to XML."),
+		rejects: r.Counter("gscltmsd_schema_rejects_total",
+			"Messages violating JSON schema of their route.", "route"),
+		sqlDuration: r.Histogram("gscltmsd_sql_call_duration_seconds",
+			"Duration of SQL server calls by procedure or route.", metrics.DefBuckets, "procedure"),
+		sqlErrors: r.Counter("gscltmsd_sql_errors_total",
+			"Failed SQL server calls by error number.", "number"),
+		reconnects: r.Counter("gscltmsd_mqtt_reconnects_total",
+			"Reconnects to MQTT server."),
+	}
+
+	r.GaugeFunc("gscltmsd_handlers_in_flight", "Messages being handled.", func() float64 {
+		return float64(atomic.LoadInt64(&m.inflight))
+	})
+	r.GaugeFunc("gscltmsd_queue_length", "Messages waiting for a worker.", func() float64 {
+		return float64(s.pool.Len())
+	})
+	r.GaugeFunc("gscltmsd_spool_depth", "Messages waiting in spool.", func() float64 {
+		if s.spool == nil {
+			return 0
+		}
+		return float64(s.spool.Len())
+	})
+	r.GaugeFunc("gscltmsd_db_open_connections", "Established connections to SQL server.", func() float64 {
+		return float64(s.dbStats().OpenConnections)
+	})
+	r.GaugeFunc("gscltmsd_db_in_use_connections", "Connections to SQL server in use.", func() float64 {
+		return float64(s.dbStats().InUse)
+	})
+	r.GaugeFunc("gscltmsd_db_idle_connections", "Idle connections to SQL server.", func() float64 {
+		return float64(s.dbStats().Idle)
+	})
+	r.CounterFunc("gscltmsd_db_wait_count_total", "Connections waited for.", func() float64 {
+		return float64(s.dbStats().WaitCount)
+	})
+	r.CounterFunc("gscltmsd_db_wait_duration_seconds_total", "Time blocked waiting for a connection.", func() float64 {
+		return s.dbStats().WaitDuration.Seconds()
+	})
+	return m
+}
+
+// dbStats return connection pool statistics, zero until connected
+func (s *Service) dbStats() (st sql.DBStats) {
+	s.mu.Lock()
+	pool := s.db
+	s.mu.Unlock()
+	if pool != nil {
+		st = pool.Stats()
+	}
+	return st
+}
+
+// callLabel return label of SQL server calls of route in metrics: procedure name,
+// or name of route if it runs a query or inserts into a table
+func callLabel(r *route.Options) string {
+	if r.Table != nil || len(r.Query) > 0 {
+		return r.ID()
+	}
+	return r.EntryPointFunc
+}
+
+// observeCall record duration and error number of SQL server call labeled with procedure or route name
+func (m *serviceMetrics) observeCall(label string, start time.Time, err error) {
+	m.sqlDuration.Observe(time.Since(start).Seconds(), label)
+	if err == nil {
+		return
+	}
+	if n, ok := db.ErrorNumber(err); ok {
+		m.sqlErrors.Inc(strconv.Itoa(int(n)))
+	} else {
+		m.sqlErrors.Inc("other")
+	}
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gkhit/gscltmsd/outbox"
+)
+
+// pollOutbox publish messages of SQL server outbox to MQTT until service is stopping
+func (s *Service) pollOutbox() {
+	defer s.wg.Done()
+
+	p := outbox.New(&s.opt.Outbox, s.db, s.publishOutbox)
+	t := time.NewTicker(time.Duration(s.opt.Outbox.Interval) * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-t.C:
+		}
+
+		if !s.Status().MqttConnected {
+			continue
+		}
+		sent, failed, err := p.Poll(context.Background())
+		if err != nil {
+			s.log.Printf("[WARN] Outbox poll stopped after %d sent, %d failed messages. %v\n", sent, failed, err)
+		} else if sent > 0 || failed > 0 {
+			s.log.Printf("[INFO] Outbox published %d messages, %d failed.\n", sent, failed)
+		}
+	}
+}
+
+// publishOutbox publish outbox message and wait for acknowledgement of MQTT server
+func (s *Service) publishOutbox(topic string, qos byte, retain bool, payload []byte) error {
+	if s.stopping() {
+		return errStopping
+	}
+	token := s.clt.Publish(topic, qos, retain, payload)
+	if !token.WaitTimeout(time.Duration(s.opt.Outbox.Timeout) * time.Second) {
+		return errors.New("publish timed out")
+	}
+	return token.Error()
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	fl "github.com/gkhit/gscltmsd/filelog"
+	"github.com/gkhit/gscltmsd/httpsrv"
+	"github.com/gkhit/gscltmsd/metrics"
+)
+
+// Process pipelines run by one binary, sharing log file and HTTP listener.
+// Each pipeline has own connections, workers, spool and dead letters, so failure of one doesn't stall others.
+type Process struct {
+	opt       *Options
+	pipelines []*Service
+	registry  *metrics.Registry
+	http      *httpsrv.Server
+}
+
+// NewProcess return new process instance, top level options are the only pipeline if no pipelines are configured.
+// Call Start to connect and run it.
+func NewProcess(o *Options) (*Process, error) {
+	fl.NewWithOptions(&o.FileLog)
+	p := &Process{
+		opt:      o,
+		registry: metrics.NewRegistry(),
+	}
+
+	opts := o.Pipelines
+	if len(opts) == 0 {
+		opts = []*Options{o}
+	}
+	names := make(map[string]bool)
+	for _, po := range opts {
+		if names[po.Name] {
+			return nil, fmt.Errorf("duplicate pipeline name \"%s\"", po.Name)
+		}
+		names[po.Name] = true
+
+		r := p.registry
+		if len(o.Pipelines) > 0 {
+			r = r.With("pipeline", po.Name)
+		}
+		s, err := newService(po, r)
+		if err != nil {
+			if len(o.Pipelines) > 0 {
+				err = fmt.Errorf("pipeline \"%s\". %v", po.Name, err)
+			}
+			return nil, err
+		}
+		p.pipelines = append(p.pipelines, s)
+	}
+
+	if o.HTTP.Enable {
+		p.http = httpsrv.New(&o.HTTP)
+		p.http.Handle("/livez", http.HandlerFunc(p.livezHandler))
+		p.http.Handle("/healthz", http.HandlerFunc(p.healthzHandler))
+		p.http.Handle("/readyz", http.HandlerFunc(p.readyzHandler))
+		p.http.Handle("/metrics", p.registry)
+	}
+	return p, nil
+}
+
+// Start starting process, blocks until interrupted and all pipelines are stopped
+func (p *Process) Start() {
+	if p.http != nil {
+		p.http.Start()
+	}
+	for _, s := range p.pipelines {
+		s.start()
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+
+	// Pipelines are independent, so they are stopped at once
+	var wg sync.WaitGroup
+	for _, s := range p.pipelines {
+		wg.Add(1)
+		go func(s *Service) {
+			defer wg.Done()
+			s.shutdown()
+		}(s)
+	}
+	wg.Wait()
+
+	if p.http != nil {
+		if err := p.http.Shutdown(5 * time.Second); err != nil {
+			log.Printf("[WARN] Shutdown: can't stop HTTP server. %v\n", err)
+		}
+	}
+	log.Println("[INFO] Shutdown complete.")
+}
+
+// loadPipelines load "pipelines" array of configuration, each pipeline starts from copy of top level options
+func (o *Options) loadPipelines(data []byte) error {
+	var cfg struct {
+		Pipelines []json.RawMessage `json:"pipelines"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	if len(cfg.Pipelines) == 0 {
+		return nil
+	}
+
+	base, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	for i, raw := range cfg.Pipelines {
+		po := new(Options)
+		if err = json.Unmarshal(base, po); err != nil {
+			return err
+		}
+		po.Name = fmt.Sprintf("pipeline%d", i+1)
+		po.Routes = nil
+		if err = json.Unmarshal(raw, po); err != nil {
+			return fmt.Errorf("pipeline %d. %v", i+1, err)
+		}
+		po.separate(o)
+		o.Pipelines = append(o.Pipelines, po)
+	}
+	return nil
+}
+
+// separate keep files of pipeline apart from the ones of other pipelines, unless they are configured explicitly
+func (o *Options) separate(top *Options) {
+	if o.Spool.Directory == top.Spool.Directory {
+		o.Spool.Directory = filepath.Join(o.Spool.Directory, o.Name)
+	}
+	if o.DeadLetter.Directory == top.DeadLetter.Directory && o.DeadLetter.Filename == top.DeadLetter.Filename {
+		o.DeadLetter.Filename = o.Name + "." + o.DeadLetter.Filename
+	}
+	if o.Reject.Directory == top.Reject.Directory && o.Reject.Filename == top.Reject.Filename {
+		o.Reject.Filename = o.Name + "." + o.Reject.Filename
+	}
+	if len(o.Dedup.File) > 0 && o.Dedup.File == top.Dedup.File {
+		o.Dedup.File = filepath.Join(filepath.Dir(o.Dedup.File), o.Name+"."+filepath.Base(o.Dedup.File))
+	}
+	// Clients with the same ID disconnect each other
+	if len(o.Mqtt.ClientID) > 0 && o.Mqtt.ClientID == top.Mqtt.ClientID {
+		o.Mqtt.ClientID += "-" + o.Name
+	}
+	if len(o.Mqtt.StoreDir) > 0 && o.Mqtt.StoreDir == top.Mqtt.StoreDir {
+		o.Mqtt.StoreDir = filepath.Join(o.Mqtt.StoreDir, o.Name)
+	}
+}
+
+// newLogger return logger prefixing messages with name of pipeline, standard logger if name is empty
+func newLogger(name string) *log.Logger {
+	if len(name) <= 0 {
+		return log.Default()
+	}
+	return log.New(log.Writer(), "["+name+"] ", log.Flags()|log.Lmsgprefix)
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gkhit/gscltmsd/db"
+	"github.com/gkhit/gscltmsd/route"
+)
+
+// replyMessage body of reply published to MQTT
+type replyMessage struct {
+	Topic    string    `json:"topic"`
+	Received time.Time `json:"received"`
+	*db.Result
+}
+
+// reply publish results of entry point call to reply topic of message.
+// Message is handled by SQL server already, so failure to publish is only logged.
+func (s *Service) reply(r *route.Options, msg *message, res *db.Result) {
+	if !r.Reply.Empty && len(res.Rows) == 0 && len(res.Output) == 0 && res.ReturnStatus == 0 {
+		return
+	}
+
+	topic := r.ReplyTopic(msg.Topic)
+	data, err := json.Marshal(&replyMessage{Topic: msg.Topic, Received: msg.Received, Result: res})
+	if err != nil {
+		s.log.Printf("[ERROR] Can't encode reply to topic \"%s\". %v\n", topic, err)
+		return
+	}
+	if s.clt == nil || !s.clt.IsConnectionOpen() {
+		s.log.Printf("[WARN] MQTT server is not connected, reply to topic \"%s\" dropped.\n", topic)
+		return
+	}
+
+	token := s.clt.Publish(topic, r.Reply.Qos, r.Reply.Retain, data)
+	if !token.WaitTimeout(time.Duration(s.opt.Database.Timeout)*time.Second) || token.Error() != nil {
+		s.log.Printf("[WARN] Can't publish reply to topic \"%s\". %v\n", topic, token.Error())
+		return
+	}
+	if s.opt.Debug {
+		s.log.Printf("[DEBUG] Reply published to topic \"%s\".\n", topic)
+	}
+}
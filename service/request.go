@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/gkhit/gscltmsd/db"
+	"github.com/gkhit/gscltmsd/request"
+)
+
+// getRequestHandler return handler of request topic, requests are served in own goroutines
+func (s *Service) getRequestHandler() mqtt.MessageHandler {
+	return func(client mqtt.Client, m mqtt.Message) {
+		req, err := s.requests.Parse(m.Payload())
+		if err != nil {
+			s.log.Printf("[WARN] Request of topic \"%s\" dropped. %v\n", m.Topic(), err)
+			return
+		}
+
+		// Shutdown closes quit under lock, so no request is added once it waits for in-flight ones
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.stopping() {
+			return
+		}
+		s.inflight.Add(1)
+		go s.serve(m.Topic(), req)
+	}
+}
+
+// serve call procedure of request and publish response
+func (s *Service) serve(topic string, req *request.Request) {
+	defer s.inflight.Done()
+
+	if s.opt.Debug {
+		s.log.Printf("[DEBUG] Request of topic \"%s\" to procedure \"%s\".\n", topic, req.Procedure)
+	}
+	res, err := s.requests.Call(s.ctx, req, s.query)
+	resp := &request.Response{CorrelationID: req.CorrelationID, OK: err == nil, Result: res}
+	if err != nil {
+		s.log.Printf("[WARN] Request of topic \"%s\" to procedure \"%s\" failed. %v\n", topic, req.Procedure, err)
+		resp.Error = err.Error()
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		s.log.Printf("[ERROR] Can't encode response to topic \"%s\". %v\n", req.ResponseTopic, err)
+		return
+	}
+	token := s.clt.Publish(req.ResponseTopic, s.opt.Requests.Qos, false, data)
+	if !token.WaitTimeout(time.Duration(s.opt.Requests.Timeout)*time.Second) || token.Error() != nil {
+		s.log.Printf("[WARN] Can't publish response to topic \"%s\". %v\n", req.ResponseTopic, token.Error())
+	}
+}
+
+// query call query procedure once, requester retries if needed
+func (s *Service) query(ctx context.Context, query string, args []interface{}) (*db.Result, error) {
+	s.mu.Lock()
+	pool := s.db
+	s.mu.Unlock()
+	if pool == nil {
+		return nil, errors.New("SQL server is not ready")
+	}
+	if s.opt.Debug {
+		s.log.Printf("[DEBUG] %s %v\n", query, args)
+	}
+
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	res, err := db.QueryResult(ctx, conn, query, args)
+	s.metrics.observeCall(query, start, err)
+	return res, err
+}
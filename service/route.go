@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/gkhit/gscltmsd/db"
+	"github.com/gkhit/gscltmsd/route"
+)
+
+// routeList return configured routes or the single route of mqtt and database sections.
+// Entry point and XML options missing in route are taken from database section,
+// topic filter missing in route or mqtt section is derived from topic template.
+func (o *Options) routeList() []*route.Options {
+	if len(o.Routes) == 0 {
+		topic := o.Mqtt.Topic
+		if len(o.Mqtt.TopicTemplate) > 0 {
+			topic = route.TemplateFilter(o.Mqtt.TopicTemplate)
+		}
+		return []*route.Options{{
+			Topic:             topic,
+			Qos:               o.Mqtt.Qos,
+			EntryPointFunc:    o.Database.EntryPointFunc,
+			ToXML:             o.Database.ToXML,
+			XMLRoot:           o.Database.XMLRoot,
+			XMLExtArray:       &o.Database.XMLExtArray,
+			Format:            o.Database.Format,
+			JSONCanonical:     o.Database.JSONCanonical,
+			JSONMinify:        o.Database.JSONMinify,
+			JSONKeyCase:       o.Database.JSONKeyCase,
+			Query:             o.Database.Query,
+			Params:            o.Database.Params,
+			DeviceIDSegment:   o.Database.DeviceIDSegment,
+			Template:          o.Mqtt.TopicTemplate,
+			SegmentAttributes: o.Database.SegmentAttributes,
+			SegmentParams:     o.Database.SegmentParams,
+			SegmentFields:     o.Database.SegmentFields,
+			Table:             o.Database.Table,
+			Bulk:              o.Database.Bulk,
+			Flatten:           o.Database.Flatten,
+			Reply:             o.Database.Reply,
+			Schema:            o.Database.Schema,
+			SchemaFile:        o.Database.SchemaFile,
+		}}
+	}
+
+	routes := make([]*route.Options, 0, len(o.Routes))
+	for i := range o.Routes {
+		r := &o.Routes[i]
+		if len(r.EntryPointFunc) <= 0 {
+			r.EntryPointFunc = o.Database.EntryPointFunc
+		}
+		if len(r.XMLRoot) <= 0 {
+			r.XMLRoot = o.Database.XMLRoot
+		}
+		// Format set in database section doesn't override to_xml of route
+		if r.Format == route.DefaultFormat && r.ToXML == nil {
+			r.Format = o.Database.Format
+		}
+		if r.ToXML == nil {
+			r.ToXML = o.Database.ToXML
+		}
+		if r.XMLExtArray == nil {
+			r.XMLExtArray = &o.Database.XMLExtArray
+		}
+		if len(r.Topic) <= 0 {
+			r.Topic = route.TemplateFilter(r.Template)
+		}
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+// routeOf return route of message. Messages read back from spool or dead letters
+// are matched by route name first and by topic then.
+func (s *Service) routeOf(msg *message) *route.Options {
+	if msg.route != nil {
+		return msg.route
+	}
+	for _, r := range s.routes {
+		if len(msg.Route) > 0 && r.ID() == msg.Route {
+			msg.route = r
+			return r
+		}
+	}
+	if r := route.Find(s.routes, msg.Topic); r != nil {
+		msg.route = r
+		return r
+	}
+	msg.route = s.routes[0]
+	return msg.route
+}
+
+// prepareTables check tables of routes inserting into tables and build their statements
+func (s *Service) prepareTables(pool *sql.DB) (map[*route.Options]*db.Inserter, error) {
+	inserters := make(map[*route.Options]*db.Inserter)
+	for _, r := range s.routes {
+		if r.Table == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, time.Duration(s.opt.Database.Timeout)*time.Second)
+		ins, err := db.NewInserter(ctx, pool, r.Table)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("route \"%s\". %v", r.ID(), err)
+		}
+		inserters[r] = ins
+	}
+	return inserters, nil
+}
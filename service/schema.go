@@ -0,0 +1,74 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gkhit/gscltmsd/deadletter"
+	"github.com/gkhit/gscltmsd/route"
+	"github.com/gkhit/gscltmsd/schema"
+)
+
+// loadSchemas compile JSON schemas of routes
+func loadSchemas(routes []*route.Options) (map[*route.Options]*schema.Schema, error) {
+	schemas := make(map[*route.Options]*schema.Schema)
+	for _, r := range routes {
+		sc, err := r.LoadSchema()
+		if err != nil {
+			return nil, err
+		}
+		if sc != nil {
+			schemas[r] = sc
+		}
+	}
+	return schemas, nil
+}
+
+// valid validate payload of message against JSON schema of its route before any SQL server call.
+// Message violating schema is sent to reject destination.
+func (s *Service) valid(msg *message) bool {
+	err := s.validate(msg)
+	if err == nil {
+		return true
+	}
+
+	s.metrics.rejects.Inc(msg.Route)
+	s.log.Printf("[WARN] Message of topic \"%s\" rejected. %v\n", msg.Topic, err)
+	s.reject(msg, err)
+	return false
+}
+
+// validate check payload of message against JSON schema of its route, nil if route has no schema
+func (s *Service) validate(msg *message) error {
+	sc := s.schemas[s.routeOf(msg)]
+	if sc == nil {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(msg.Payload, &v); err != nil {
+		s.metrics.parseFailures.Inc()
+		return &schema.Error{Violations: []schema.Violation{{Path: "$", Message: "must be valid JSON. " + err.Error()}}}
+	}
+	return sc.Validate(v)
+}
+
+// reject write message to reject destination, dead-letter one is used if it's disabled
+func (s *Service) reject(msg *message, cause error) {
+	if s.rj == nil {
+		s.deadLetter(msg, nil, cause, 0)
+		return
+	}
+
+	err := s.rj.Write(&deadletter.Entry{
+		Topic:    msg.Topic,
+		Payload:  string(msg.Payload),
+		Error:    cause.Error(),
+		Received: msg.Received,
+		Failed:   time.Now(),
+	})
+	if err != nil {
+		s.log.Printf("[ERROR] Can't write rejected message of topic \"%s\", message lost. %v\n", msg.Topic, err)
+	}
+	msg.finish(err == nil)
+}
@@ -4,38 +4,107 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gkhit/gscltmsd/db"
+	"github.com/gkhit/gscltmsd/deadletter"
+	"github.com/gkhit/gscltmsd/dedup"
 	fl "github.com/gkhit/gscltmsd/filelog"
+	"github.com/gkhit/gscltmsd/httpsrv"
+	"github.com/gkhit/gscltmsd/metrics"
 	"github.com/gkhit/gscltmsd/mq"
+	"github.com/gkhit/gscltmsd/outbox"
+	"github.com/gkhit/gscltmsd/pipeline"
+	"github.com/gkhit/gscltmsd/request"
+	"github.com/gkhit/gscltmsd/route"
+	"github.com/gkhit/gscltmsd/schema"
 	"github.com/gkhit/gscltmsd/sm2x"
+	"github.com/gkhit/gscltmsd/spool"
 )
 
 type (
 	// Options
 	Options struct {
+		// Name of pipeline, prefixes its log messages and labels its metrics
+		Name     string     `json:"name,omitempty"`
 		Mqtt     mq.Options `json:"mqtt"`
 		Database db.Options `json:"database"`
-		FileLog  fl.Options `json:"file_log,omitempty"`
-		Debug    bool       `json:"debug,omitempty"`
+		// Routes topic filters mapped to entry points, the single route of mqtt and database sections is used if empty
+		Routes     []route.Options    `json:"routes,omitempty"`
+		Pipeline   pipeline.Options   `json:"pipeline,omitempty"`
+		FileLog    fl.Options         `json:"file_log,omitempty"`
+		Spool      spool.Options      `json:"spool,omitempty"`
+		DeadLetter deadletter.Options `json:"dead_letter,omitempty"`
+		Dedup      dedup.Options      `json:"dedup,omitempty"`
+		Outbox     outbox.Options     `json:"outbox,omitempty"`
+		Requests   request.Options    `json:"requests,omitempty"`
+		HTTP       httpsrv.Options    `json:"http,omitempty"`
+		Debug      bool               `json:"debug,omitempty"`
+		// Reject destination of messages violating JSON schema of their route, dead-letter one is used if disabled
+		Reject deadletter.Options `json:"reject,omitempty"`
+		// ShutdownTimeout grace period in seconds to handle queued messages on shutdown
+		ShutdownTimeout int64 `json:"shutdown_timeout,omitempty"`
+		// Pipelines independent pipelines run by the process, loaded from "pipelines" array.
+		// Options of a pipeline default to the top level ones.
+		Pipelines []*Options `json:"-"`
 	}
 
 	// Service
 	Service struct {
-		opt *Options
-		db  *sql.DB
-		clt mqtt.Client
-		ctx context.Context
+		opt      *Options
+		log      *log.Logger
+		db       *sql.DB
+		clt      mqtt.Client
+		ctx      context.Context
+		cancel   context.CancelFunc
+		quit     chan struct{}
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		status   Status
+		stats    *callStats
+		metrics  *serviceMetrics
+		connects int
+		routes   []*route.Options
+		// inserters of routes inserting into tables, set once connected to SQL server
+		inserters map[*route.Options]*db.Inserter
+		spool     *spool.Spool
+		pool      *pipeline.Pool
+		batcher   *pipeline.Batcher
+		bulks     map[*route.Options]*pipeline.Batcher
+		dl        deadletter.Writer
+		dedup     *dedup.Filter
+		// rj reject destination, nil if disabled
+		rj deadletter.Writer
+		// schemas compiled JSON schemas of routes which have one
+		schemas map[*route.Options]*schema.Schema
+		// requests server of request/response queries, nil if disabled
+		requests *request.Server
+		inflight sync.WaitGroup
+	}
+
+	// message received MQTT message
+	message struct {
+		Topic     string    `json:"topic"`
+		Payload   []byte    `json:"payload"`
+		Received  time.Time `json:"received"`
+		Route     string    `json:"route,omitempty"`
+		Qos       byte      `json:"qos,omitempty"`
+		Retained  bool      `json:"retained,omitempty"`
+		Duplicate bool      `json:"duplicate,omitempty"`
+		MessageID uint16    `json:"message_id,omitempty"`
+		route     *route.Options
+		done      func(ok bool)
 	}
 )
 
@@ -50,6 +119,11 @@ func NewOptions() *Options {
 
 	logDir = filepath.Join(logDir, "log")
 
+	spoolDir := "/var/spool/gscltmsd"
+	if runtime.GOOS == "windows" {
+		spoolDir = filepath.Join(cwd, "spool")
+	}
+
 	return &Options{
 		Mqtt: mq.Options{
 			Host:                 "127.0.0.1",
@@ -62,6 +136,7 @@ func NewOptions() *Options {
 			MaxReconnectInterval: 60,
 			Qos:                  0,
 			Topic:                "#",
+			CleanSession:         true,
 		},
 		Database: db.Options{
 			Host:        "127.0.0.1",
@@ -69,9 +144,22 @@ func NewOptions() *Options {
 			DBName:      "master",
 			User:        "sa",
 			Timeout:     30,
-			ToXML:       false,
 			XMLRoot:     "doc",
 			XMLExtArray: false,
+			BatchRoot:   "batch",
+			// Partial batch must be flushed by timer, handlers may wait for it in at-least-once mode
+			BatchInterval: 1000,
+
+			RetryAttempts:    5,
+			RetryInterval:    500,
+			RetryMaxInterval: 30000,
+			RetryMaxElapsed:  120,
+		},
+		Pipeline: pipeline.Options{
+			Workers:          8,
+			QueueSize:        1000,
+			QueuePolicy:      pipeline.BlockPolicy,
+			MaxInflightBytes: 64 << 20,
 		},
 		FileLog: fl.Options{
 			Enable:     false,
@@ -80,7 +168,67 @@ func NewOptions() *Options {
 			MaxAge:     10,
 			MaxBackups: 7,
 		},
-		Debug: false,
+		Spool: spool.Options{
+			Enable:        false,
+			Directory:     spoolDir,
+			SegmentSize:   16,
+			MaxSize:       1024,
+			MaxAge:        720,
+			DrainInterval: 10,
+		},
+		DeadLetter: deadletter.Options{
+			Enable:      false,
+			Destination: deadletter.FileDestination,
+			Directory:   logDir,
+			MaxSize:     25,
+			MaxAge:      30,
+			MaxBackups:  7,
+			Topic:       "gscltmsd/dead_letter",
+			Qos:         1,
+			Table:       "dbo.gscltmsd_dead_letter",
+			Timeout:     30,
+		},
+		Reject: deadletter.Options{
+			Enable:      false,
+			Destination: deadletter.FileDestination,
+			Directory:   logDir,
+			MaxSize:     25,
+			MaxAge:      30,
+			MaxBackups:  7,
+			Topic:       "gscltmsd/reject",
+			Qos:         1,
+			Table:       "dbo.gscltmsd_reject",
+			Timeout:     30,
+		},
+		Dedup: dedup.Options{
+			Enable:       false,
+			Window:       600,
+			MaxEntries:   100000,
+			SaveInterval: 60,
+		},
+		Outbox: outbox.Options{
+			Enable:    false,
+			Table:     "dbo.gscltmsd_outbox",
+			Interval:  5,
+			BatchSize: 100,
+			Timeout:   30,
+		},
+		Requests: request.Options{
+			Enable:         false,
+			Topic:          "gscltmsd/request/#",
+			ResponsePrefix: "gscltmsd/response",
+			Qos:            1,
+			Timeout:        30,
+			MaxConcurrent:  4,
+		},
+		HTTP: httpsrv.Options{
+			Enable:       false,
+			Listen:       ":8080",
+			ErrorWindow:  300,
+			MaxErrorRate: 0.5,
+		},
+		Debug:           false,
+		ShutdownTimeout: 30,
 	}
 }
 
@@ -106,94 +254,584 @@ func (o *Options) Load(path string) error {
 		return err
 	}
 
-	return nil
+	return o.loadPipelines(byteValue)
 }
 
-// New return new service instance
-func New(o *Options) (s *Service) {
-	fl.NewWithOptions(&o.FileLog)
+// newService return new pipeline instance registering its metrics in r, call start to connect and run it
+func newService(o *Options, r *metrics.Registry) (s *Service, err error) {
 	s = &Service{
-		opt: o,
-		db:  db.New(&o.Database),
+		opt:   o,
+		log:   newLogger(o.Name),
+		pool:  pipeline.New(&o.Pipeline),
+		quit:  make(chan struct{}),
+		stats: newCallStats(o.HTTP.ErrorWindow),
+	}
+	o.Database.Logger = s.log
+	o.Mqtt.Logger = s.log
+	o.Mqtt.Name = o.Name
+	s.metrics = s.newMetrics(r)
+	if err = o.Pipeline.Validate(); err != nil {
+		return nil, err
+	}
+	s.routes = o.routeList()
+	for _, r := range s.routes {
+		if err = r.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if s.schemas, err = loadSchemas(s.routes); err != nil {
+		return nil, err
+	}
+	for _, d := range []*deadletter.Options{&o.DeadLetter, &o.Reject} {
+		if !d.Enable || d.Destination != deadletter.MqttDestination {
+			continue
+		}
+		if r := route.Find(s.routes, d.Topic); r != nil {
+			s.log.Printf("[WARN] Dead letters published to topic \"%s\" are received back by route \"%s\".\n",
+				d.Topic, r.ID())
+		}
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if o.Spool.Enable {
+		if s.spool, err = spool.New(&o.Spool); err != nil {
+			return nil, fmt.Errorf("can't open spool directory \"%s\". %v", o.Spool.Directory, err)
+		}
+		if n := s.spool.Len(); n > 0 {
+			s.log.Printf("[INFO] Spool contains %d pending messages.\n", n)
+		}
+	}
+	// Writer of SQL destination is created once connected to SQL server
+	if o.DeadLetter.Enable && o.DeadLetter.Destination != deadletter.SQLDestination {
+		if s.dl, err = deadletter.New(&o.DeadLetter, s.publish, nil); err != nil {
+			return nil, fmt.Errorf("can't open dead-letter destination. %v", err)
+		}
+	}
+	if o.Reject.Enable && o.Reject.Destination != deadletter.SQLDestination {
+		if s.rj, err = deadletter.New(&o.Reject, s.publish, nil); err != nil {
+			return nil, fmt.Errorf("can't open reject destination. %v", err)
+		}
+	}
+	if o.Dedup.Enable {
+		if s.dedup, err = dedup.New(&o.Dedup); err != nil {
+			return nil, fmt.Errorf("can't load deduplication file \"%s\". %v", o.Dedup.File, err)
+		}
+	}
+	if o.Database.BatchSize > 1 {
+		if len(o.Database.BatchEntryPointFunc) <= 0 {
+			return nil, fmt.Errorf("batch_entry_point is required when batch_size is %d", o.Database.BatchSize)
+		}
+		if o.Database.BatchInterval <= 0 {
+			return nil, fmt.Errorf("batch_interval must be positive when batch_size is %d", o.Database.BatchSize)
+		}
+		s.batcher = pipeline.NewBatcher(o.Database.BatchSize,
+			time.Duration(o.Database.BatchInterval)*time.Millisecond, s.processBatch)
+	}
+	s.bulks = s.newBulkLoaders()
+	if o.Requests.Enable {
+		if s.requests, err = request.New(&o.Requests); err != nil {
+			return nil, err
+		}
+	}
+	// Ordering needs messages in order of arrival, so handlers can't run in own goroutines
+	o.Mqtt.AsyncHandlers = o.Pipeline.AtLeastOnce && o.Pipeline.OrderBy == pipeline.NoOrder
+	if o.Pipeline.AtLeastOnce && o.Pipeline.OrderBy != pipeline.NoOrder {
+		s.log.Println("[WARN] At-least-once mode with ordering handles messages one by one")
 	}
 	o.Mqtt.OnConnectHandler = s.getOnConnectHandler()
-	s.clt = mq.NewClient(&o.Mqtt)
-	return
+	o.Mqtt.OnConnectionLost = s.getConnectionLostHandler()
+	// Handlers are set before connecting, so messages queued by broker for persistent session
+	// are handled as soon as they arrive after CONNACK
+	o.Mqtt.OnMessage = s.getDispatchHandler()
+	if s.clt, err = mq.NewClient(&o.Mqtt); err != nil {
+		return nil, fmt.Errorf("can't configure MQTT client. %v", err)
+	}
+	// Messages of request topic are handled by request handler only, they don't reach dispatch handler of routes
+	if s.requests != nil {
+		s.clt.AddRoute(o.Requests.Topic, s.getRequestHandler())
+	}
+	return s, nil
 }
 
-// Start starting service instance
-func (s *Service) Start() {
+// start connect to SQL and MQTT servers in background
+func (s *Service) start() {
+	s.wg.Add(1)
+	go s.connect()
+	if s.dedup != nil && len(s.opt.Dedup.File) > 0 && s.opt.Dedup.SaveInterval > 0 {
+		s.wg.Add(1)
+		go s.saveDedup()
+	}
+}
 
-	var cancel context.CancelFunc
+func (s *Service) getOnConnectHandler() mqtt.OnConnectHandler {
+	var f = func(client mqtt.Client) {
+		s.log.Println("[INFO] Connect MQTT server successful")
+		s.setStatus(func(st *Status) { st.MqttConnected = true })
+		s.mu.Lock()
+		s.connects++
+		if s.connects > 1 {
+			s.metrics.reconnects.Inc()
+		}
+		s.mu.Unlock()
+		if s.stopping() {
+			return
+		}
+		// Handler must not block, so subscription is retried in background
+		go s.retry("Subscribe to routes", func() error {
+			if !client.IsConnectionOpen() {
+				return nil
+			}
+			for _, r := range s.routes {
+				token := client.Subscribe(r.Topic, r.Qos, nil)
+				if token.Wait() && token.Error() != nil {
+					return fmt.Errorf("topic \"%s\". %v", r.Topic, token.Error())
+				}
+				s.log.Printf("[INFO] Subscribe to topic \"%s\" successful.\n", r.Topic)
+			}
+			if s.requests != nil {
+				token := client.Subscribe(s.opt.Requests.Topic, s.opt.Requests.Qos, nil)
+				if token.Wait() && token.Error() != nil {
+					return fmt.Errorf("topic \"%s\". %v", s.opt.Requests.Topic, token.Error())
+				}
+				s.log.Printf("[INFO] Subscribe to request topic \"%s\" successful.\n", s.opt.Requests.Topic)
+			}
+			s.setStatus(func(st *Status) {
+				st.Subscribed = true
+				st.State = StateRunning
+			})
+			return nil
+		})
+	}
+	return f
+}
 
-	s.ctx, cancel = context.WithCancel(context.Background())
+func (s *Service) getConnectionLostHandler() mqtt.ConnectionLostHandler {
+	var f = func(client mqtt.Client, err error) {
+		s.log.Printf("[WARN] Connection MQTT server lost: %v\n", err)
+		s.setStatus(func(st *Status) {
+			st.MqttConnected = false
+			st.Subscribed = false
+			if st.State == StateRunning {
+				st.State = StateConnecting
+			}
+		})
+	}
+	return f
+}
 
-	defer cancel()
+// getDispatchHandler return handler of messages of all routes. Message is handled by the first route
+// matching its topic, so it's handled once even if filters of several routes match it.
+func (s *Service) getDispatchHandler() mqtt.MessageHandler {
+	handlers := make(map[*route.Options]mqtt.MessageHandler, len(s.routes))
+	for _, r := range s.routes {
+		handlers[r] = s.getHandler(r)
+	}
+	return func(client mqtt.Client, m mqtt.Message) {
+		r := route.Find(s.routes, m.Topic())
+		if r == nil {
+			s.log.Printf("[WARN] No route of topic \"%s\", message skipped.\n", m.Topic())
+			return
+		}
+		handlers[r](client, m)
+	}
+}
 
-	// if token := s.clt.Subscribe(s.opt.Mqtt.Topic, s.opt.Mqtt.Qos, s.getHandler()); token.Wait() && token.Error() != nil {
-	// 	log.Fatalf("[ERROR] Can't subscribe to topic \"%s\". %v\n", s.opt.Mqtt.Topic, token.Error())
-	// }
+func (s *Service) getHandler(r *route.Options) mqtt.MessageHandler {
+	var f = func(client mqtt.Client, m mqtt.Message) {
+		if s.stopping() && !s.opt.Mqtt.CleanSession {
+			// Hold message without acknowledgment until disconnect, broker redelivers it to the next run
+			<-s.ctx.Done()
+			return
+		}
+		msg := &message{
+			Topic:     m.Topic(),
+			Payload:   m.Payload(),
+			Received:  time.Now(),
+			Route:     r.ID(),
+			route:     r,
+			Qos:       m.Qos(),
+			Retained:  m.Retained(),
+			Duplicate: m.Duplicate(),
+			MessageID: m.MessageID(),
+		}
+		s.metrics.received.Inc(msg.Route)
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
-	s.clt.Disconnect(250)
-}
+		var done chan bool
+		if s.opt.Pipeline.AtLeastOnce {
+			done = make(chan bool, 1)
+			msg.done = func(ok bool) { done <- ok }
+		}
 
-func (s *Service) getOnConnectHandler() mqtt.OnConnectHandler {
-	var f = func(client mqtt.Client) {
-		log.Println("[INFO] Connect MQTT server successful")
-		if token := client.Subscribe(s.opt.Mqtt.Topic, s.opt.Mqtt.Qos, s.getHandler()); token.Wait() && token.Error() != nil {
-			log.Fatalf("[ERROR] Can't subscribe to topic \"%s\". %v\n", s.opt.Mqtt.Topic, token.Error())
-		} else {
-			log.Printf("[INFO] Subscribe to topic \"%s\" successful.\n", s.opt.Mqtt.Topic)
+		if s.dedup != nil {
+			key := s.dedup.Key(msg.Topic, msg.Payload)
+			if s.dedup.Seen(key) {
+				if s.opt.Debug {
+					s.log.Printf("[DEBUG] Duplicate message of topic \"%s\" suppressed, %d in total.\n",
+						msg.Topic, s.dedup.Suppressed())
+				}
+				return
+			}
+			// Message failed to be handled must not be suppressed when delivered again
+			ack := msg.done
+			msg.done = func(ok bool) {
+				if !ok {
+					s.dedup.Forget(key)
+				}
+				if ack != nil {
+					ack(ok)
+				}
+			}
+		}
+
+		s.submit(msg)
+
+		// Message is acknowledged when handler returns
+		if done != nil && !<-done {
+			s.redeliver(msg, done)
 		}
 	}
 	return f
 }
 
-func (s *Service) getHandler() mqtt.MessageHandler {
-	var f = func(client mqtt.Client, message mqtt.Message) {
-		go s.mqttHandler(client, message)
+// submit put message to worker pool
+func (s *Service) submit(msg *message) {
+	s.pool.Submit(&pipeline.Job{
+		Key:  s.opt.Pipeline.OrderKey(msg.Topic, msg.Payload),
+		Size: len(msg.Payload),
+		Run:  func() { s.mqttHandler(msg) },
+		Drop: func() {
+			if s.stopping() {
+				if s.spool != nil {
+					s.toSpool(msg)
+					return
+				}
+				s.log.Printf("[WARN] Service is stopping, message of topic \"%s\" dropped.\n", msg.Topic)
+			} else {
+				s.log.Printf("[WARN] Queue is full, message of topic \"%s\" dropped.\n", msg.Topic)
+			}
+			msg.finish(false)
+		},
+	})
+}
+
+// redeliver submit message failed in at-least-once mode again with backoff until it's handled,
+// broker doesn't redeliver unacknowledged message before reconnect.
+// Message left unhandled on shutdown is held without acknowledgment until disconnect.
+func (s *Service) redeliver(msg *message, done chan bool) {
+	if !s.retry(fmt.Sprintf("Handle message of topic \"%s\"", msg.Topic), func() error {
+		// Pool and batchers are closed on shutdown
+		if s.stopping() {
+			return errStopping
+		}
+		s.submit(msg)
+		if !<-done {
+			return errors.New("message is not handled")
+		}
+		return nil
+	}) {
+		<-s.ctx.Done()
 	}
-	return f
 }
 
-func (s *Service) mqttHandler(c mqtt.Client, m mqtt.Message) {
+func (s *Service) mqttHandler(msg *message) {
+	atomic.AddInt64(&s.metrics.inflight, 1)
+	defer atomic.AddInt64(&s.metrics.inflight, -1)
+
+	// Keep order of messages while the spool is not drained
+	if s.spool != nil && s.spool.Len() > 0 {
+		s.toSpool(msg)
+		return
+	}
+
+	if !s.valid(msg) {
+		return
+	}
+	payload, err := s.convert(msg)
+	if err != nil {
+		s.deadLetter(msg, nil, err, 0)
+		return
+	}
+
+	r := s.routeOf(msg)
+	if b := s.bulks[r]; b != nil {
+		b.AddSized(&batchItem{msg: msg, payload: payload}, len(payload))
+		return
+	}
+	if s.batchable(r) {
+		s.batcher.Add(&batchItem{msg: msg, payload: payload})
+		return
+	}
+
+	s.send(msg, payload)
+}
+
+// send call SQL server entry point, spool message on transient error and dead-letter it on permanent one
+func (s *Service) send(msg *message, payload []byte) {
+	n, err := s.exec(msg, payload)
+	if err == nil {
+		msg.finish(true)
+		return
+	}
+	if s.spool != nil && s.transient(err) {
+		s.toSpool(msg)
+		return
+	}
+	s.deadLetter(msg, payload, err, n)
+}
+
+// process convert message and call SQL server entry point, returns only transient database errors
+func (s *Service) process(msg *message) error {
+	if !s.valid(msg) {
+		return nil
+	}
+	payload, err := s.convert(msg)
+	if err != nil {
+		s.deadLetter(msg, nil, err, 0)
+		return nil
+	}
+	n, err := s.exec(msg, payload)
+	if err != nil && !s.transient(err) {
+		s.deadLetter(msg, payload, err, n)
+		return nil
+	}
+	return err
+}
+
+// convert convert payload of message to format of its route
+func (s *Service) convert(msg *message) ([]byte, error) {
 	var (
 		err     error
 		payload []byte
 		src     map[string]interface{}
+		r       = s.routeOf(msg)
+		segs    = r.Segments(msg.Topic)
 	)
 
-	if err = json.Unmarshal(m.Payload(), &src); err != nil {
-		log.Printf("[ERROR] Can't converting data of topic \"%s\". %v\n", m.Topic(), err)
-		return
+	switch {
+	case r.Flatten != nil:
+		// Leaves are taken from JSON payload when parameters are built
+		if !json.Valid(msg.Payload) {
+			s.metrics.parseFailures.Inc()
+			s.log.Printf("[ERROR] Can't converting data of topic \"%s\". %v\n", msg.Topic, route.ErrInvalidJSON)
+			return nil, route.ErrInvalidJSON
+		}
+		return msg.Payload, nil
+	case r.Encoding() == route.RawFormat:
+		return msg.Payload, nil
+	case r.Encoding() == route.JSONFormat:
+		payload = msg.Payload
+		if r.SegmentFields {
+			payload, err = route.AddFields(payload, segs)
+		}
+		if err == nil {
+			payload, err = r.EncodeJSON(payload)
+		}
+		if err != nil {
+			s.metrics.parseFailures.Inc()
+			s.log.Printf("[ERROR] Can't converting data of topic \"%s\". %v\n", msg.Topic, err)
+			return nil, err
+		}
+		return payload, nil
+	}
+
+	if err = json.Unmarshal(msg.Payload, &src); err != nil {
+		s.metrics.parseFailures.Inc()
+		s.log.Printf("[ERROR] Can't converting data of topic \"%s\". %v\n", msg.Topic, err)
+		return nil, err
+	}
+	for _, sg := range segs {
+		if _, ok := src[sg.Name]; r.SegmentFields && !ok {
+			src[sg.Name] = sg.Value
+		}
+		// Keys starting with hyphen are converted to attributes
+		if r.SegmentAttributes {
+			src["-"+sg.Name] = sg.Value
+		}
 	}
 
-	if s.opt.Database.XMLExtArray {
+	if r.XMLExtArray != nil && *r.XMLExtArray {
 		cp := sm2x.DefaultConversionParameters()
 		cp.ExtendArray = true
-		payload, err = sm2x.Map2XMLParameters(src, cp, s.opt.Database.XMLRoot)
+		payload, err = sm2x.Map2XMLParameters(src, cp, r.XMLRoot)
 	} else {
-		payload, err = sm2x.Map2XML(src, s.opt.Database.XMLRoot)
+		payload, err = sm2x.Map2XML(src, r.XMLRoot)
+	}
+	if err != nil {
+		s.metrics.convFailures.Inc()
+		s.log.Printf("[ERROR] Can't converting data of topic \"%s\" to XML. %v\n", msg.Topic, err)
+		return nil, err
+	}
+	return payload, nil
+}
+
+// exec call SQL server entry point of message route or insert message into its table,
+// returns number of attempts made
+func (s *Service) exec(msg *message, payload []byte) (int, error) {
+	r := s.routeOf(msg)
+	m := &route.Message{
+		Topic:     msg.Topic,
+		Payload:   msg.Payload,
+		Received:  msg.Received,
+		Qos:       msg.Qos,
+		Retained:  msg.Retained,
+		Duplicate: msg.Duplicate,
+		MessageID: msg.MessageID,
 	}
 
-	ctx, cancel := context.WithTimeout(s.ctx, time.Duration(s.opt.Database.Timeout)*time.Second)
-	defer cancel()
-	conn, err := s.db.Conn(ctx)
+	if r.Bulk != nil {
+		return s.bulkLoad(r, [][]interface{}{bulkRow(r, msg, payload)})
+	}
+	if r.Table != nil {
+		ins := s.inserters[r]
+		args, err := ins.Args(r, m, payload)
+		if err != nil {
+			s.log.Printf("[ERROR] Can't build row of table \"%s\" for topic \"%s\". %v\n", r.Table.Name, msg.Topic, err)
+			return 0, err
+		}
+		return s.call(callLabel(r), ins.Statement(), args...)
+	}
+
+	args, err := r.Args(m, payload)
 	if err != nil {
-		log.Printf("[ERROR] Can't connect to SQL server. %v\n", err)
-		return
+		s.log.Printf("[ERROR] Can't build entry point parameters for topic \"%s\". %v\n", msg.Topic, err)
+		return 0, err
 	}
-	defer conn.Close()
+	if r.Reply == nil {
+		return s.call(callLabel(r), r.Statement(), args...)
+	}
+
+	res, n, err := s.callResult(callLabel(r), r.Statement(), args...)
+	if err == nil {
+		s.reply(r, msg, res)
+	}
+	return n, err
+}
 
+// call call SQL server procedure with arguments, transient errors are retried.
+// Call is labeled in metrics with label. Returns number of attempts made.
+func (s *Service) call(label, query string, args ...interface{}) (int, error) {
+	return s.do(label, query, args, func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, query, args...)
+		return err
+	})
+}
+
+// callResult call SQL server procedure with arguments and read its results, transient errors are retried.
+// Call is labeled in metrics with label. Returns number of attempts made.
+func (s *Service) callResult(label, query string, args ...interface{}) (res *db.Result, n int, err error) {
+	n, err = s.do(label, query, args, func(ctx context.Context, conn *sql.Conn) error {
+		var err error
+		res, err = db.QueryResult(ctx, conn, query, args)
+		return err
+	})
+	return res, n, err
+}
+
+// do run fn on connection of pool with timeout, transient errors are retried.
+// Call is labeled in metrics with label. Returns number of attempts made.
+func (s *Service) do(label, query string, args []interface{}, fn func(ctx context.Context, conn *sql.Conn) error) (int, error) {
 	if s.opt.Debug {
-		log.Printf("[DEBUG] %s %s\n", m.Topic(), string(payload))
+		s.log.Printf("[DEBUG] %s %v\n", query, args)
 	}
 
-	_, err = conn.ExecContext(ctx, s.opt.Database.EntryPointFunc, m.Topic(), string(payload))
+	n, err := db.Retry(s.ctx, &s.opt.Database, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(s.opt.Database.Timeout)*time.Second)
+		defer cancel()
+		conn, err := s.db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		start := time.Now()
+		err = fn(ctx, conn)
+		s.metrics.observeCall(label, start, err)
+		return err
+	})
+	s.stats.add(err)
+	if err != nil {
+		s.log.Printf("[ERROR] Call SQL server entry point error. %v\n", err)
+	}
+	return n, err
+}
+
+// transient check whether call error is worth spooling for replay
+func (s *Service) transient(err error) bool {
+	return db.IsTransient(err, s.opt.Database.RetriableErrors)
+}
+
+// toSpool store message in spool for replay
+func (s *Service) toSpool(msg *message) {
+	data, err := json.Marshal(msg)
+	if err == nil {
+		err = s.spool.Put(data)
+	}
 	if err != nil {
-		log.Printf("[ERROR] Call SQL server entry point error. %v\n", err)
+		s.log.Printf("[ERROR] Can't store message of topic \"%s\" in spool, message lost. %v\n", msg.Topic, err)
+	}
+	msg.finish(err == nil)
+}
+
+// finish report outcome of message handling, acknowledgment waits for it in at-least-once mode
+func (m *message) finish(ok bool) {
+	if m.done != nil {
+		m.done(ok)
+	}
+}
+
+// drainSpool periodically replay spooled messages in order
+func (s *Service) drainSpool() {
+	defer s.wg.Done()
+
+	t := time.NewTicker(time.Duration(s.opt.Spool.DrainInterval) * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-t.C:
+		}
+
+		depth := s.spool.Len()
+		if depth <= 0 {
+			continue
+		}
+		s.log.Printf("[INFO] Spool depth %d messages, replaying...\n", depth)
+
+		n, err := s.spool.Drain(func(data []byte) error {
+			if s.stopping() {
+				return errStopping
+			}
+			msg := new(message)
+			if err := json.Unmarshal(data, msg); err != nil {
+				s.log.Printf("[ERROR] Can't decode spooled message, skipped. %v\n", err)
+				return nil
+			}
+			return s.process(msg)
+		})
+		if err != nil {
+			s.log.Printf("[WARN] Spool replay stopped after %d messages, %d pending. %v\n", n, s.spool.Len(), err)
+		} else {
+			s.log.Printf("[INFO] Spool replayed %d messages, %d pending.\n", n, s.spool.Len())
+		}
+	}
+}
+
+// saveDedup periodically save messages remembered by deduplication filter
+func (s *Service) saveDedup() {
+	defer s.wg.Done()
+
+	t := time.NewTicker(time.Duration(s.opt.Dedup.SaveInterval) * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-t.C:
+		}
+		if err := s.dedup.Save(); err != nil {
+			s.log.Printf("[ERROR] Can't save deduplication file \"%s\". %v\n", s.opt.Dedup.File, err)
+		}
 	}
 }
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"errors"
+	"time"
+)
+
+var errStopping = errors.New("service is stopping")
+
+// stopping check whether shutdown is in progress
+func (s *Service) stopping() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stop service in order, so no accepted message is lost
+func (s *Service) shutdown() {
+	grace := time.Duration(s.opt.ShutdownTimeout) * time.Second
+
+	s.setStatus(func(st *Status) { st.State = StateStopping })
+	topics := make([]string, 0, len(s.routes))
+	for _, r := range s.routes {
+		topics = append(topics, r.Topic)
+	}
+	if s.requests != nil {
+		topics = append(topics, s.opt.Requests.Topic)
+	}
+	s.mu.Lock()
+	close(s.quit)
+	s.mu.Unlock()
+	if s.opt.Mqtt.CleanSession {
+		s.log.Printf("[INFO] Shutdown: unsubscribe from topics %q.\n", topics)
+		if token := s.clt.Unsubscribe(topics...); !token.WaitTimeout(grace) || token.Error() != nil {
+			s.log.Printf("[WARN] Shutdown: can't unsubscribe from topics. %v\n", token.Error())
+		}
+	} else {
+		// Broker keeps queueing messages of persistent session while service is down
+		s.log.Printf("[INFO] Shutdown: stop handling topics %q, subscriptions are kept.\n", topics)
+	}
+
+	s.log.Printf("[INFO] Shutdown: handle %d queued messages, grace period %v.\n", s.pool.Len(), grace)
+	if n := s.pool.Close(grace); n > 0 {
+		if s.spool != nil {
+			s.log.Printf("[WARN] Shutdown: grace period expired, %d queued messages spooled.\n", n)
+		} else {
+			s.log.Printf("[WARN] Shutdown: grace period expired, %d queued messages dropped.\n", n)
+		}
+	}
+	if s.batcher != nil {
+		s.batcher.Close()
+	}
+	for _, b := range s.bulks {
+		b.Close()
+	}
+	// Wait for spool replay, connection attempts and requests
+	s.wg.Wait()
+	s.inflight.Wait()
+	s.log.Println("[INFO] Shutdown: in-flight SQL server calls finished.")
+
+	if s.spool != nil {
+		if n := s.spool.Len(); n > 0 {
+			s.log.Printf("[INFO] Shutdown: %d messages left in spool.\n", n)
+		}
+		s.spool.Close()
+	}
+	if s.dedup != nil {
+		if err := s.dedup.Close(); err != nil {
+			s.log.Printf("[ERROR] Can't save deduplication file \"%s\". %v\n", s.opt.Dedup.File, err)
+		}
+	}
+
+	// Dead letters may be published to MQTT server or written to SQL server, so close it before them
+	if s.dl != nil {
+		s.dl.Close()
+	}
+	if s.rj != nil {
+		s.rj.Close()
+	}
+
+	if s.db != nil {
+		s.log.Println("[INFO] Shutdown: close SQL server connection pool.")
+		if err := s.db.Close(); err != nil {
+			s.log.Printf("[WARN] Shutdown: can't close SQL server connection pool. %v\n", err)
+		}
+	}
+
+	s.log.Println("[INFO] Shutdown: disconnect MQTT server.")
+	s.clt.Disconnect(250)
+
+	// Release held messages after disconnect, so they are not acknowledged
+	s.cancel()
+	s.log.Println("[INFO] Shutdown: pipeline stopped.")
+}
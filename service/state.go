@@ -0,0 +1,134 @@
+package service
+
+import (
+	"time"
+
+	"github.com/gkhit/gscltmsd/db"
+	"github.com/gkhit/gscltmsd/deadletter"
+	"github.com/gkhit/gscltmsd/mq"
+)
+
+type (
+	// State state of service
+	State int
+
+	// Status current state of service and its connections
+	Status struct {
+		State         State
+		MqttConnected bool
+		DatabaseReady bool
+		Subscribed    bool
+	}
+)
+
+const (
+	// StateConnecting Ожидание подключения к MQTT и SQL серверам
+	StateConnecting State = iota
+	// StateRunning Обработка сообщений
+	StateRunning
+	// StateStopping Остановка
+	StateStopping
+)
+
+var toStringState = map[State]string{
+	StateConnecting: "connecting",
+	StateRunning:    "running",
+	StateStopping:   "stopping",
+}
+
+func (s State) String() string {
+	return toStringState[s]
+}
+
+// Status return current state of service
+func (s *Service) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// setStatus change status under lock and log the new state
+func (s *Service) setStatus(f func(st *Status)) {
+	s.mu.Lock()
+	prev := s.status
+	f(&s.status)
+	st := s.status
+	s.mu.Unlock()
+
+	if st != prev {
+		s.log.Printf("[INFO] Service state: %s, MQTT connected: %t, subscribed: %t, SQL server ready: %t\n",
+			st.State, st.MqttConnected, st.Subscribed, st.DatabaseReady)
+	}
+}
+
+// connect connect to SQL and MQTT servers in background with backoff, consuming starts once both are ready
+func (s *Service) connect() {
+	defer s.wg.Done()
+
+	if !s.retry("Connect to SQL server", func() error {
+		pool, err := db.New(&s.opt.Database)
+		if err != nil {
+			return err
+		}
+		inserters, err := s.prepareTables(pool)
+		if err != nil {
+			pool.Close()
+			return err
+		}
+		s.mu.Lock()
+		s.db = pool
+		s.inserters = inserters
+		s.mu.Unlock()
+		return nil
+	}) {
+		return
+	}
+	s.setStatus(func(st *Status) { st.DatabaseReady = true })
+
+	if s.dl == nil && s.opt.DeadLetter.Enable {
+		// SQL destination needs connection pool, it can't fail to open
+		s.dl, _ = deadletter.New(&s.opt.DeadLetter, s.publish, s.db)
+	}
+	if s.rj == nil && s.opt.Reject.Enable {
+		s.rj, _ = deadletter.New(&s.opt.Reject, s.publish, s.db)
+	}
+	if s.spool != nil {
+		s.wg.Add(1)
+		go s.drainSpool()
+	}
+	if s.opt.Outbox.Enable {
+		s.wg.Add(1)
+		go s.pollOutbox()
+	}
+
+	s.retry("Connect to MQTT server", func() error {
+		return mq.Connect(s.clt)
+	})
+}
+
+// retry call fn with backoff until it succeeds or service is stopping
+func (s *Service) retry(action string, fn func() error) bool {
+	interval := time.Second
+	maxInterval := time.Duration(s.opt.Mqtt.MaxReconnectInterval) * time.Second
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+
+	for {
+		err := fn()
+		if err == nil {
+			return true
+		}
+		s.log.Printf("[WARN] %s failed, retry in %v. %v\n", action, interval, err)
+
+		select {
+		case <-s.quit:
+			return false
+		case <-time.After(interval):
+		}
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
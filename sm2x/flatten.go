@@ -0,0 +1,66 @@
+package sm2x
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Leaf scalar value of map with path of keys leading to it
+type Leaf struct {
+	Path  string
+	Value interface{}
+}
+
+// Flatten walk map the same way Map2XML does and return its scalar values in document order.
+// Path levels are joined with sep, elements of arrays are numbered from 0.
+// Attribute keys are used without hyphen, '#text' value belongs to its element.
+func Flatten(m map[string]interface{}, sep string) []Leaf {
+	var leaves []Leaf
+	flatten(&leaves, "", m, sep)
+	return leaves
+}
+
+func flatten(leaves *[]Leaf, path string, value interface{}, sep string) {
+	switch vv := value.(type) {
+	case map[string]interface{}:
+		// attributes first, then elements, both sorted on key
+		keys := make([]string, 0, len(vv))
+		for k := range vv {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			ai, aj := strings.HasPrefix(keys[i], "-"), strings.HasPrefix(keys[j], "-")
+			if ai != aj {
+				return ai
+			}
+			return keys[i] < keys[j]
+		})
+		for _, k := range keys {
+			switch {
+			case k == "#text":
+				flatten(leaves, path, vv[k], sep)
+			case strings.HasPrefix(k, "-"):
+				flatten(leaves, join(path, k[1:], sep), vv[k], sep)
+			default:
+				flatten(leaves, join(path, k, sep), vv[k], sep)
+			}
+		}
+	case []interface{}:
+		for i, v := range vv {
+			flatten(leaves, join(path, strconv.Itoa(i), sep), v, sep)
+		}
+	case nil, string, bool, float64, float32, int, int32, int64, fmt.Stringer:
+		*leaves = append(*leaves, Leaf{Path: path, Value: value})
+	default:
+		*leaves = append(*leaves, Leaf{Path: path, Value: fmt.Sprint(value)})
+	}
+}
+
+func join(path, key, sep string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + sep + key
+}
@@ -2,10 +2,12 @@ package sm2x
 
 import (
 	"bytes"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"reflect"
 	"sort"
+	"strings"
 )
 
 // ConvParameters Conversion parameters
@@ -156,7 +158,7 @@ func mapToXML(s *string, key string, value interface{}, p *ConvParameters, paren
 	}
 
 	switch value.(type) {
-	case map[string]interface{}, []byte, string, float64, bool, int, int32, int64, float32:
+	case map[string]interface{}, []byte, string, float64, bool, int, int32, int64, float32, json.Number:
 		*s += `<` + key
 	case []interface{}:
 		if parent == reflect.Slice && p.ExtendArray {
@@ -172,7 +174,7 @@ func mapToXML(s *string, key string, value interface{}, p *ConvParameters, paren
 		var n int
 		var ss string
 		for k, v := range vv {
-			if k[:1] == "-" {
+			if strings.HasPrefix(k, "-") {
 				switch v.(type) {
 				case string:
 					ss = v.(string)
@@ -181,7 +183,7 @@ func mapToXML(s *string, key string, value interface{}, p *ConvParameters, paren
 					}
 					attrlist[n][0] = k[1:]
 					attrlist[n][1] = ss
-				case bool, int, int32, int64:
+				case bool, int, int32, int64, json.Number:
 					attrlist[n][0] = k[1:]
 					attrlist[n][1] = fmt.Sprintf("%v", v)
 				case float64, float32:
@@ -244,7 +246,7 @@ func mapToXML(s *string, key string, value interface{}, p *ConvParameters, paren
 		elemlist := make([][2]interface{}, len(vv))
 		n = 0
 		for k, v := range vv {
-			if k[:1] == "-" {
+			if strings.HasPrefix(k, "-") {
 				continue
 			}
 			elemlist[n][0] = k
@@ -291,7 +293,7 @@ func mapToXML(s *string, key string, value interface{}, p *ConvParameters, paren
 			if elen > 0 {
 				*s += ">" + v
 			}
-		case bool, int, int32, int64:
+		case bool, int, int32, int64, json.Number:
 			v := fmt.Sprintf("%v", value)
 			elen = len(v) // always > 0
 			*s += ">" + v
@@ -339,7 +341,7 @@ func mapToXML(s *string, key string, value interface{}, p *ConvParameters, paren
 	}
 	if endTag {
 		switch value.(type) {
-		case map[string]interface{}, []byte, string, float64, bool, int, int32, int64, float32, nil:
+		case map[string]interface{}, []byte, string, float64, bool, int, int32, int64, float32, json.Number, nil:
 			if elen > 0 || p.GoEmptyElementSyntax {
 				if elen == 0 {
 					*s += ">"
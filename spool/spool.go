@@ -0,0 +1,457 @@
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Options options of on-disk store-and-forward spool
+	Options struct {
+		Enable bool `json:"enable,omitempty"`
+		// Directory to store spool segments in
+		Directory string `json:"directory"`
+		// SegmentSize the max size in MB of a segment file before a new one is started
+		SegmentSize int `json:"segment_size"`
+		// MaxSize the max size in MB of all segments, the oldest segments are dropped when exceeded
+		MaxSize int `json:"max_size"`
+		// MaxAge the max age in hours to keep a segment
+		MaxAge int `json:"max_age"`
+		// DrainInterval interval in seconds between attempts to replay the spool
+		DrainInterval int64 `json:"drain_interval"`
+	}
+
+	// Spool durable append-only FIFO queue of records
+	Spool struct {
+		o       *Options
+		mu      sync.Mutex
+		drainMu sync.Mutex
+		segs    []*segment
+		lastSeq uint64
+		w       *os.File // writer of the last segment
+		r       *os.File // reader of the first segment
+		rseq    uint64
+		roff    int64 // read offset in the first segment
+		done    int   // records consumed in the first segment
+	}
+
+	segment struct {
+		seq     uint64
+		size    int64
+		records int
+		modTime time.Time
+	}
+)
+
+const (
+	headerSize    = 8
+	maxRecordSize = 64 << 20
+	segmentExt    = ".seg"
+	cursorFile    = "cursor"
+	megabyte      = 1 << 20
+)
+
+var (
+	// ErrCorrupted record checksum or length mismatch
+	ErrCorrupted = errors.New("spool record corrupted")
+	// ErrTooLarge record exceeds the max record size
+	ErrTooLarge = errors.New("spool record too large")
+)
+
+// New open spool in directory, pending records of previous runs are kept
+func New(o *Options) (*Spool, error) {
+	if err := os.MkdirAll(o.Directory, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{o: o}
+
+	cseq, coff, err := s.loadCursor()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(o.Directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != segmentExt {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq > s.lastSeq {
+			s.lastSeq = seq
+		}
+		// Segments before the cursor are consumed already
+		if seq < cseq {
+			os.Remove(s.path(seq))
+			continue
+		}
+		s.segs = append(s.segs, &segment{seq: seq, modTime: f.ModTime()})
+	}
+	sort.Slice(s.segs, func(i, j int) bool { return s.segs[i].seq < s.segs[j].seq })
+	if cseq > 0 && s.lastSeq < cseq-1 {
+		s.lastSeq = cseq - 1
+	}
+
+	for i, sg := range s.segs {
+		off := int64(0)
+		if i == 0 && sg.seq == cseq {
+			off = coff
+		}
+		if err = s.scan(sg, off, i == 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Put append record to the end of spool
+func (s *Spool) Put(data []byte) error {
+	if len(data) > maxRecordSize {
+		return ErrTooLarge
+	}
+
+	buf := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[headerSize:], data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.w == nil || s.segs[len(s.segs)-1].size >= int64(s.o.SegmentSize)*megabyte {
+		if err := s.roll(); err != nil {
+			return err
+		}
+	}
+
+	sg := s.segs[len(s.segs)-1]
+	if _, err := s.w.Write(buf); err != nil {
+		return err
+	}
+	if err := s.w.Sync(); err != nil {
+		return err
+	}
+	sg.size += int64(len(buf))
+	sg.records++
+	sg.modTime = time.Now()
+
+	s.limitSize()
+	return nil
+}
+
+// Drain replay pending records in order through fn, stops at the first error of fn.
+// Returns number of replayed records.
+func (s *Spool) Drain(fn func(data []byte) error) (int, error) {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	s.mu.Lock()
+	s.limitAge()
+	s.mu.Unlock()
+
+	n := 0
+	for {
+		s.mu.Lock()
+		data, seq, next, err := s.next()
+		s.mu.Unlock()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if err = fn(data); err != nil {
+			return n, err
+		}
+
+		s.mu.Lock()
+		// The segment could be dropped by size or age limits while fn was running
+		if len(s.segs) > 0 && s.segs[0].seq == seq && s.roff < next {
+			s.roff = next
+			s.done++
+			err = s.saveCursor()
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// Len return number of pending records
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := -s.done
+	for _, sg := range s.segs {
+		n += sg.records
+	}
+	return n
+}
+
+// Size return size of all segments in bytes
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for _, sg := range s.segs {
+		n += sg.size
+	}
+	return n
+}
+
+// Close close segment files
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeReader()
+	if s.w != nil {
+		err := s.w.Close()
+		s.w = nil
+		return err
+	}
+	return nil
+}
+
+// next read record at cursor, consumed segments are removed on the way
+func (s *Spool) next() (data []byte, seq uint64, next int64, err error) {
+	for {
+		if len(s.segs) == 0 {
+			return nil, 0, 0, io.EOF
+		}
+		sg := s.segs[0]
+		if s.roff >= sg.size {
+			if s.w != nil && len(s.segs) == 1 {
+				// Reached the segment being written
+				return nil, 0, 0, io.EOF
+			}
+			if err = s.removeFirst(); err != nil {
+				return nil, 0, 0, err
+			}
+			continue
+		}
+
+		if s.r == nil || s.rseq != sg.seq {
+			s.closeReader()
+			if s.r, err = os.Open(s.path(sg.seq)); err != nil {
+				return nil, 0, 0, err
+			}
+			s.rseq = sg.seq
+		}
+
+		data, err = readRecord(s.r, s.roff)
+		if err != nil {
+			log.Printf("[WARN] Spool segment \"%s\" corrupted at offset %d, skipping rest of segment. %v\n",
+				s.path(sg.seq), s.roff, err)
+			s.done = sg.records
+			s.roff = sg.size
+			continue
+		}
+		return data, sg.seq, s.roff + headerSize + int64(len(data)), nil
+	}
+}
+
+// scan count valid records of segment, a torn tail is truncated
+func (s *Spool) scan(sg *segment, from int64, first bool) error {
+	f, err := os.OpenFile(s.path(sg.seq), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var off int64
+	for {
+		data, err := readRecord(f, off)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("[WARN] Spool segment \"%s\" corrupted at offset %d, truncating. %v\n",
+				s.path(sg.seq), off, err)
+			if err = f.Truncate(off); err != nil {
+				return err
+			}
+			break
+		}
+		if first && off < from {
+			s.done++
+		}
+		off += headerSize + int64(len(data))
+		sg.records++
+	}
+	sg.size = off
+	if first {
+		s.roff = from
+		if s.roff > sg.size {
+			s.roff = sg.size
+			s.done = sg.records
+		}
+	}
+	return nil
+}
+
+// roll start new segment for writing
+func (s *Spool) roll() (err error) {
+	if s.w != nil {
+		if err = s.w.Close(); err != nil {
+			return err
+		}
+		s.w = nil
+	}
+	s.lastSeq++
+	s.w, err = os.OpenFile(s.path(s.lastSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	s.segs = append(s.segs, &segment{seq: s.lastSeq, modTime: time.Now()})
+	if len(s.segs) == 1 {
+		s.roff, s.done = 0, 0
+		return s.saveCursor()
+	}
+	return nil
+}
+
+// removeFirst delete the first segment and move cursor to the next one
+func (s *Spool) removeFirst() error {
+	sg := s.segs[0]
+	if s.w != nil && len(s.segs) == 1 {
+		s.w.Close()
+		s.w = nil
+	}
+	s.closeReader()
+	s.segs = s.segs[1:]
+	s.roff, s.done = 0, 0
+	if err := s.saveCursor(); err != nil {
+		return err
+	}
+	return os.Remove(s.path(sg.seq))
+}
+
+// limitSize drop the oldest segments while total size exceeds the limit
+func (s *Spool) limitSize() {
+	if s.o.MaxSize <= 0 {
+		return
+	}
+	var total int64
+	for _, sg := range s.segs {
+		total += sg.size
+	}
+	for total > int64(s.o.MaxSize)*megabyte && len(s.segs) > 1 {
+		sg := s.segs[0]
+		log.Printf("[WARN] Spool size limit %d MB exceeded, dropping %d records of segment \"%s\".\n",
+			s.o.MaxSize, sg.records-s.done, s.path(sg.seq))
+		total -= sg.size
+		if err := s.removeFirst(); err != nil {
+			log.Printf("[ERROR] Can't remove spool segment \"%s\". %v\n", s.path(sg.seq), err)
+			return
+		}
+	}
+}
+
+// limitAge drop segments older than the limit
+func (s *Spool) limitAge() {
+	if s.o.MaxAge <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-time.Duration(s.o.MaxAge) * time.Hour)
+	for len(s.segs) > 0 && s.segs[0].modTime.Before(deadline) {
+		sg := s.segs[0]
+		log.Printf("[WARN] Spool age limit %d h exceeded, dropping %d records of segment \"%s\".\n",
+			s.o.MaxAge, sg.records-s.done, s.path(sg.seq))
+		if err := s.removeFirst(); err != nil {
+			log.Printf("[ERROR] Can't remove spool segment \"%s\". %v\n", s.path(sg.seq), err)
+			return
+		}
+	}
+}
+
+func (s *Spool) closeReader() {
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.o.Directory, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// loadCursor read position of the first pending record
+func (s *Spool) loadCursor() (seq uint64, off int64, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.o.Directory, cursorFile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err = fmt.Sscan(string(b), &seq, &off); err != nil {
+		log.Printf("[WARN] Spool cursor is invalid, replaying from the beginning. %v\n", err)
+		return 0, 0, nil
+	}
+	return seq, off, nil
+}
+
+// saveCursor atomically write position of the first pending record
+func (s *Spool) saveCursor() error {
+	var seq uint64
+	if len(s.segs) > 0 {
+		seq = s.segs[0].seq
+	} else {
+		seq = s.lastSeq + 1
+	}
+	name := filepath.Join(s.o.Directory, cursorFile)
+	if err := ioutil.WriteFile(name+".tmp", []byte(fmt.Sprintf("%d %d\n", seq, s.roff)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// readRecord read and verify record at offset
+func readRecord(f *os.File, off int64) ([]byte, error) {
+	var hdr [headerSize]byte
+	n, err := f.ReadAt(hdr[:], off)
+	if err == io.EOF && n == 0 {
+		return nil, io.EOF
+	}
+	if n < headerSize {
+		return nil, ErrCorrupted
+	}
+
+	size := binary.BigEndian.Uint32(hdr[0:4])
+	if size > maxRecordSize {
+		return nil, ErrCorrupted
+	}
+	data := make([]byte, size)
+	if n, _ = f.ReadAt(data, off+headerSize); n < int(size) {
+		return nil, ErrCorrupted
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, ErrCorrupted
+	}
+	return data, nil
+}
@@ -0,0 +1,289 @@
+package spool
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T, o *Options) *Spool {
+	t.Helper()
+	s, err := New(o)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s
+}
+
+func put(t *testing.T, s *Spool, records ...string) {
+	t.Helper()
+	for _, r := range records {
+		if err := s.Put([]byte(r)); err != nil {
+			t.Fatalf("Put(%q): %v", r, err)
+		}
+	}
+}
+
+// drain replay up to limit records, all if limit is negative
+func drain(t *testing.T, s *Spool, limit int) []string {
+	t.Helper()
+	stop := errors.New("stop")
+	var got []string
+	_, err := s.Drain(func(data []byte) error {
+		if limit >= 0 && len(got) >= limit {
+			return stop
+		}
+		got = append(got, string(data))
+		return nil
+	})
+	if err != nil && err != stop {
+		t.Fatalf("Drain: %v", err)
+	}
+	return got
+}
+
+func equal(t *testing.T, got, want []string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestPutDrainInOrder(t *testing.T) {
+	o := &Options{Directory: t.TempDir(), SegmentSize: 1}
+	s := open(t, o)
+	defer s.Close()
+
+	put(t, s, "a", "b", "c")
+	if n := s.Len(); n != 3 {
+		t.Fatalf("Len = %d, want 3", n)
+	}
+	equal(t, drain(t, s, -1), []string{"a", "b", "c"})
+	if n := s.Len(); n != 0 {
+		t.Fatalf("Len after drain = %d, want 0", n)
+	}
+
+	put(t, s, "d")
+	equal(t, drain(t, s, -1), []string{"d"})
+}
+
+func TestDrainStopsAtError(t *testing.T) {
+	o := &Options{Directory: t.TempDir(), SegmentSize: 1}
+	s := open(t, o)
+	defer s.Close()
+
+	put(t, s, "a", "b", "c")
+	failed := errors.New("failed")
+	n, err := s.Drain(func(data []byte) error {
+		if string(data) == "b" {
+			return failed
+		}
+		return nil
+	})
+	if n != 1 || err != failed {
+		t.Fatalf("Drain = %d, %v, want 1, %v", n, err, failed)
+	}
+	// Failed record is replayed again
+	equal(t, drain(t, s, -1), []string{"b", "c"})
+}
+
+func TestRestartResumesAtCursor(t *testing.T) {
+	o := &Options{Directory: t.TempDir(), SegmentSize: 1}
+	s := open(t, o)
+	put(t, s, "a", "b", "c", "d", "e")
+	equal(t, drain(t, s, 2), []string{"a", "b"})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = open(t, o)
+	if n := s.Len(); n != 3 {
+		t.Fatalf("Len after restart = %d, want 3", n)
+	}
+	put(t, s, "f")
+	equal(t, drain(t, s, 1), []string{"c"})
+	s.Close()
+
+	s = open(t, o)
+	defer s.Close()
+	equal(t, drain(t, s, -1), []string{"d", "e", "f"})
+	if n := s.Len(); n != 0 {
+		t.Fatalf("Len = %d, want 0", n)
+	}
+}
+
+func TestRestartRemovesConsumedSegments(t *testing.T) {
+	o := &Options{Directory: t.TempDir(), SegmentSize: 1}
+	s := open(t, o)
+	put(t, s, "a")
+	s.Close()
+
+	// Each run writes its own segment
+	s = open(t, o)
+	put(t, s, "b")
+	s.Close()
+	if n := len(segments(t, o.Directory)); n != 2 {
+		t.Fatalf("%d segments, want 2", n)
+	}
+
+	s = open(t, o)
+	equal(t, drain(t, s, -1), []string{"a", "b"})
+	s.Close()
+
+	s = open(t, o)
+	defer s.Close()
+	if n := s.Len(); n != 0 {
+		t.Fatalf("Len = %d, want 0", n)
+	}
+	if n := len(segments(t, o.Directory)); n > 1 {
+		t.Fatalf("%d segments left, want at most 1", n)
+	}
+}
+
+func TestTornTailIsTruncated(t *testing.T) {
+	o := &Options{Directory: t.TempDir(), SegmentSize: 1}
+	s := open(t, o)
+	put(t, s, "a", "b")
+	s.Close()
+
+	name := segments(t, o.Directory)[0]
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Crash in the middle of a write leaves a partial header and payload
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1, 2})
+	f.Close()
+
+	s = open(t, o)
+	defer s.Close()
+	if n := s.Len(); n != 2 {
+		t.Fatalf("Len = %d, want 2", n)
+	}
+	if fi2, _ := os.Stat(name); fi2.Size() != fi.Size() {
+		t.Fatalf("segment size %d, want truncated to %d", fi2.Size(), fi.Size())
+	}
+	put(t, s, "c")
+	equal(t, drain(t, s, -1), []string{"a", "b", "c"})
+}
+
+func TestCorruptedRecordOnOpen(t *testing.T) {
+	o := &Options{Directory: t.TempDir(), SegmentSize: 1}
+	s := open(t, o)
+	put(t, s, "aaaa", "bbbb", "cccc")
+	s.Close()
+
+	// Flip a byte of the second record payload, records after it are lost
+	name := segments(t, o.Directory)[0]
+	corrupt(t, name, 2*headerSize+4)
+
+	s = open(t, o)
+	defer s.Close()
+	if n := s.Len(); n != 1 {
+		t.Fatalf("Len = %d, want 1", n)
+	}
+	equal(t, drain(t, s, -1), []string{"aaaa"})
+}
+
+func TestCorruptedRecordOnDrain(t *testing.T) {
+	o := &Options{Directory: t.TempDir(), SegmentSize: 1}
+	s := open(t, o)
+	defer s.Close()
+	put(t, s, "aaaa", "bbbb", "cccc")
+
+	corrupt(t, segments(t, o.Directory)[0], 2*headerSize+4)
+
+	// Rest of corrupted segment is skipped
+	equal(t, drain(t, s, -1), []string{"aaaa"})
+	if n := s.Len(); n != 0 {
+		t.Fatalf("Len = %d, want 0", n)
+	}
+	put(t, s, "dddd")
+	equal(t, drain(t, s, -1), []string{"dddd"})
+}
+
+func TestSizeLimitDropsOldestSegment(t *testing.T) {
+	o := &Options{Directory: t.TempDir(), SegmentSize: 1, MaxSize: 1}
+	s := open(t, o)
+	defer s.Close()
+
+	record := func(c byte) string { return string(bytes.Repeat([]byte{c}, 400*1024)) }
+	// The first segment takes three records, the fourth one starts a new segment and exceeds the limit
+	put(t, s, record('a'), record('b'), record('c'), record('d'))
+
+	if n := s.Len(); n != 1 {
+		t.Fatalf("Len = %d, want 1", n)
+	}
+	if size := s.Size(); size > int64(o.MaxSize)*megabyte {
+		t.Fatalf("Size = %d, want at most %d", size, o.MaxSize*megabyte)
+	}
+	got := drain(t, s, -1)
+	if len(got) != 1 || got[0] != record('d') {
+		t.Fatalf("drained %d records, want the last one only", len(got))
+	}
+}
+
+func TestAgeLimitDropsOldSegments(t *testing.T) {
+	o := &Options{Directory: t.TempDir(), SegmentSize: 1, MaxAge: 1}
+	s := open(t, o)
+	put(t, s, "a", "b")
+	s.Close()
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range segments(t, o.Directory) {
+		if err := os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s = open(t, o)
+	defer s.Close()
+	put(t, s, "c")
+	equal(t, drain(t, s, -1), []string{"c"})
+}
+
+func TestTooLarge(t *testing.T) {
+	o := &Options{Directory: t.TempDir(), SegmentSize: 1}
+	s := open(t, o)
+	defer s.Close()
+
+	if err := s.Put(make([]byte, maxRecordSize+1)); err != ErrTooLarge {
+		t.Fatalf("Put = %v, want %v", err, ErrTooLarge)
+	}
+}
+
+// corrupt flip byte of file at offset
+func corrupt(t *testing.T, name string, off int64) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	if _, err = f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err = f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+}